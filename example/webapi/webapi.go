@@ -6,18 +6,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"time"
 
-	"github.com/BurntSushi/toml"
+	"github.com/pyama86/pftp/pftp"
 )
 
-type config struct {
-	Apiserver serverConfig `toml:"webapiserver"`
-}
-
-type serverConfig struct {
-	URI string `toml:"uri"`
-}
-
 // Response from server will contain 3 elements with JSON type.
 // {
 //	  code : http response code
@@ -30,10 +24,13 @@ type Response struct {
 	Data    string `json:"data"`
 }
 
+// request timeout to webapi server
+var client = &http.Client{Timeout: 10 * time.Second}
+
 // RequestToServer will return response data from webapi server
 // If response code doesn't got 2xx, return error.
 func RequestToServer(requestURI string, param string) (*Response, error) {
-	resp, err := http.Get(fmt.Sprintf(requestURI, param))
+	resp, err := client.Get(fmt.Sprintf(requestURI, param))
 	if err != nil {
 		return nil, err
 	}
@@ -54,19 +51,27 @@ func RequestToServer(requestURI string, param string) (*Response, error) {
 	return decodedBody, nil
 }
 
-// GetDomainFromWebAPI will return destination url by string.
-// Make request URL from config file and has request to server with username parameter.
-func GetDomainFromWebAPI(path string, param string) (*string, error) {
-	var conf config
-	_, err := toml.DecodeFile(path, &conf)
+// Resolver is an example of pftp.OriginResolver which gets origin from webapi server.
+// Set it to server by FtpServer.SetOriginResolver.
+type Resolver struct {
+	uri string
+}
+
+// NewResolver creates resolver which requests to uri. %s in uri is replaced by username
+func NewResolver(uri string) *Resolver {
+	return &Resolver{uri: uri}
+}
+
+// Resolve will return destination url of username from webapi server.
+func (r *Resolver) Resolve(ctx *pftp.Context, user string, clientAddr string) (pftp.OriginTarget, error) {
+	domain, err := RequestToServer(r.uri, url.QueryEscape(user))
 	if err != nil {
-		return nil, err
+		return pftp.OriginTarget{}, err
 	}
 
-	domain, err := RequestToServer(conf.Apiserver.URI, param)
-	if err != nil {
-		return nil, err
+	if len(domain.Data) == 0 {
+		return pftp.OriginTarget{}, pftp.ErrOriginNotFound
 	}
 
-	return &domain.Data, nil
+	return pftp.OriginTarget{Addr: domain.Data}, nil
 }
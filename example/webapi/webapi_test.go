@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/pyama86/pftp/pftp"
 	"github.com/pyama86/pftp/test"
 )
 
@@ -51,7 +52,7 @@ func Test_restapi_RequestToServer(t *testing.T) {
 				serverURI: testsrv.URL + "/getDomain?username=%s",
 			},
 			want: &Response{
-				Code:    400,
+				Code:    404,
 				Message: "Username not found",
 				Data:    "",
 			},
@@ -74,3 +75,41 @@ func Test_restapi_RequestToServer(t *testing.T) {
 		})
 	}
 }
+
+func Test_Resolver_Resolve(t *testing.T) {
+	testsrv := test.LaunchUnitTestRestServer(t)
+	defer testsrv.Close()
+
+	tests := []struct {
+		name    string
+		user    string
+		want    pftp.OriginTarget
+		wantErr bool
+	}{
+		{
+			name: "vsuser",
+			user: "vsuser",
+			want: pftp.OriginTarget{Addr: "127.0.0.1:10021"},
+		},
+		{
+			name:    "hogemoge",
+			user:    "hogemoge",
+			wantErr: true,
+		},
+	}
+
+	r := NewResolver(testsrv.URL + "/getDomain?username=%s")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Resolve(&pftp.Context{}, tt.user, "127.0.0.1:12345")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Resolver.Resolve() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolver.Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -14,6 +14,7 @@ require (
 	github.com/tevino/abool v1.2.0
 	golang.org/x/sync v0.10.0
 	golang.org/x/sys v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,183 @@
+package pftp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// accessRule permits client IP by allow and deny CIDR lists.
+// deny is evaluated first, and empty allow permits all addresses
+type accessRule struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// accessLists is global rule and each user own rules
+type accessLists struct {
+	global *accessRule
+	users  map[string]*accessRule
+}
+
+// accessControl holds access lists which can be replaced on reload
+type accessControl struct {
+	mutex sync.RWMutex
+	lists *accessLists
+}
+
+func newAccessControl(c *accessConfig) (*accessControl, error) {
+	a := &accessControl{}
+	if err := a.update(c); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// parse CIDR list. address without prefix length means single address
+func parseCIDRList(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %s", entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func newAccessRule(allow []string, deny []string) (*accessRule, error) {
+	allowNets, err := parseCIDRList(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denyNets, err := parseCIDRList(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessRule{allow: allowNets, deny: denyNets}, nil
+}
+
+func newAccessLists(c *accessConfig) (*accessLists, error) {
+	global, err := newAccessRule(c.Allow, c.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	lists := &accessLists{
+		global: global,
+		users:  make(map[string]*accessRule),
+	}
+
+	for _, u := range c.Users {
+		rule, err := newAccessRule(u.Allow, u.Deny)
+		if err != nil {
+			return nil, err
+		}
+		lists.users[u.Name] = rule
+	}
+
+	return lists, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check client IP is permitted by the rule. nil rule permits all addresses
+func (r *accessRule) permit(ip net.IP) bool {
+	if r == nil {
+		return true
+	}
+
+	if containsIP(r.deny, ip) {
+		return false
+	}
+
+	return len(r.allow) == 0 || containsIP(r.allow, ip)
+}
+
+// replace access lists. nil config permits all addresses
+func (a *accessControl) update(c *accessConfig) error {
+	var lists *accessLists
+	if c != nil {
+		l, err := newAccessLists(c)
+		if err != nil {
+			return err
+		}
+		lists = l
+	}
+
+	a.mutex.Lock()
+	a.lists = lists
+	a.mutex.Unlock()
+
+	return nil
+}
+
+func (a *accessControl) getLists() *accessLists {
+	if a == nil {
+		return nil
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return a.lists
+}
+
+// check client IP is permitted by global rule
+func (a *accessControl) permit(addr string) bool {
+	lists := a.getLists()
+	if lists == nil {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	return lists.global.permit(ip)
+}
+
+// check client IP is permitted by global rule and rule of user
+func (a *accessControl) permitUser(addr string, user string) bool {
+	lists := a.getLists()
+	if lists == nil {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	return lists.global.permit(ip) && lists.users[user].permit(ip)
+}
@@ -0,0 +1,71 @@
+package pftp
+
+import (
+	"testing"
+)
+
+func Test_accessControl_permitUser(t *testing.T) {
+	a, err := newAccessControl(&accessConfig{
+		Allow: []string{"192.168.0.0/16", "2001:db8::/32"},
+		Deny:  []string{"192.168.10.1", "2001:db8:1::/48"},
+		Users: []*accessUserConfig{
+			{
+				Name:  "prouser",
+				Allow: []string{"192.168.20.0/24"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		addr string
+		user string
+		want bool
+	}{
+		{name: "allowed_ipv4", addr: "192.168.10.2", want: true},
+		{name: "denied_ipv4", addr: "192.168.10.1", want: false},
+		{name: "not_allowed_ipv4", addr: "10.0.0.1", want: false},
+		{name: "allowed_ipv6", addr: "2001:db8::1", want: true},
+		{name: "denied_ipv6", addr: "2001:db8:1::1", want: false},
+		{name: "invalid_address", addr: "invalid", want: false},
+		{name: "user_allowed", addr: "192.168.20.1", user: "prouser", want: true},
+		{name: "user_not_allowed", addr: "192.168.10.2", user: "prouser", want: false},
+		{name: "user_without_rule", addr: "192.168.10.2", user: "anotheruser", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.permitUser(tt.addr, tt.user); got != tt.want {
+				t.Errorf("accessControl.permitUser() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_accessControl_update(t *testing.T) {
+	a, err := newAccessControl(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.permit("10.0.0.1") {
+		t.Errorf("accessControl.permit() without lists = false, want true")
+	}
+
+	if err := a.update(&accessConfig{Deny: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	if a.permit("10.0.0.1") {
+		t.Errorf("accessControl.permit() after update = true, want false")
+	}
+
+	// invalid lists are not applied
+	if err := a.update(&accessConfig{Deny: []string{"10.0.0.0/33"}}); err == nil {
+		t.Errorf("accessControl.update() error = nil, want error")
+	}
+	if a.permit("10.0.0.1") {
+		t.Errorf("accessControl.update() applied invalid lists")
+	}
+}
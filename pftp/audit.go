@@ -0,0 +1,204 @@
+package pftp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditFormatXferlog = "xferlog"
+	auditFormatJSON    = "json"
+)
+
+// transferRecord is a record of one data transfer
+type transferRecord struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	ClientIP  string    `json:"client_ip"`
+	Origin    string    `json:"origin"`
+	Command   string    `json:"command"`
+	Filename  string    `json:"filename"`
+	Direction string    `json:"direction"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	TLS       bool      `json:"tls"`
+	Status    string    `json:"status"`
+}
+
+// auditLogger writes transfer records to file
+type auditLogger struct {
+	format string
+	writer *rotateWriter
+}
+
+func newAuditLogger(c *auditLogConfig) (*auditLogger, error) {
+	w, err := newRotateWriter(c.Path, int64(c.MaxSize)*1024*1024, c.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLogger{
+		format: c.Format,
+		writer: w,
+	}, nil
+}
+
+// write transfer record by configured format
+func (a *auditLogger) write(r *transferRecord) error {
+	var line string
+
+	switch a.format {
+	case auditFormatJSON:
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		line = string(b)
+	default:
+		line = r.xferlog()
+	}
+
+	_, err := a.writer.Write([]byte(line + "\n"))
+	return err
+}
+
+// Close audit log file
+func (a *auditLogger) Close() error {
+	return a.writer.Close()
+}
+
+// format record by wu-ftpd xferlog format
+// current-time transfer-time remote-host file-size filename transfer-type special-action-flag
+// direction access-mode username service-name authentication-method authenticated-user-id completion-status
+func (r *transferRecord) xferlog() string {
+	direction := "o"
+	if r.Direction == uploadStream {
+		direction = "i"
+	}
+
+	status := "i"
+	if r.Status == "complete" {
+		status = "c"
+	}
+
+	filename := r.Filename
+	if len(filename) == 0 {
+		filename = "-"
+	}
+
+	user := r.User
+	if len(user) == 0 {
+		user = "-"
+	}
+
+	return fmt.Sprintf("%s %d %s %d %s b _ %s r %s ftp 0 * %s",
+		r.Time.Format("Mon Jan _2 15:04:05 2006"),
+		int64(math.Ceil(r.Duration)),
+		r.ClientIP,
+		r.Bytes,
+		strings.ReplaceAll(filename, " ", "_"),
+		direction,
+		strings.ReplaceAll(user, " ", "_"),
+		status,
+	)
+}
+
+// rotateWriter writes to file and rotates it when file size exceeds maxSize.
+// rotated files are renamed to path.1, path.2 ... path.maxBackups
+type rotateWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	mutex      sync.Mutex
+}
+
+func newRotateWriter(path string, maxSize int64, maxBackups int) (*rotateWriter, error) {
+	w := &rotateWriter{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// keep writing to current file when rotation failed
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			logrus.Errorf("cannot rotate audit log %s: %v", w.path, err)
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+
+	return n, err
+}
+
+// rename files to next number and open new file.
+// if current file cannot be moved, it is opened again
+func (w *rotateWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	if w.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxBackups))
+		for i := w.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return errors.Join(err, w.open())
+		}
+	} else {
+		if err := os.Remove(w.path); err != nil {
+			return errors.Join(err, w.open())
+		}
+	}
+
+	return w.open()
+}
+
+// Close file
+func (w *rotateWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.file.Close()
+}
@@ -0,0 +1,127 @@
+package pftp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_auditLogger_write(t *testing.T) {
+	record := &transferRecord{
+		Time:      time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC),
+		User:      "prouser",
+		ClientIP:  "192.168.10.1",
+		Origin:    "127.0.0.1:20021",
+		Command:   "STOR",
+		Filename:  "stor/test file.txt",
+		Direction: uploadStream,
+		Bytes:     1024,
+		Duration:  1.2,
+		TLS:       true,
+		Status:    "complete",
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{
+			name:   "xferlog",
+			format: auditFormatXferlog,
+			want:   "Thu Jan  2 03:04:05 2020 2 192.168.10.1 1024 stor/test_file.txt b _ i r prouser ftp 0 * c\n",
+		},
+		{
+			name:   "json",
+			format: auditFormatJSON,
+			want:   `{"time":"2020-01-02T03:04:05Z","user":"prouser","client_ip":"192.168.10.1","origin":"127.0.0.1:20021","command":"STOR","filename":"stor/test file.txt","direction":"upload","bytes":1024,"duration":1.2,"tls":true,"status":"complete"}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "xferlog")
+			a, err := newAuditLogger(&auditLogConfig{Path: path, Format: tt.format})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := a.write(record); err != nil {
+				t.Fatal(err)
+			}
+			a.Close()
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("auditLogger.write() = %v, want %v", string(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_rotateWriter_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xferlog")
+	w, err := newRotateWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for p, content := range want {
+		got, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("rotateWriter file %s = %v, want %v", filepath.Base(p), string(got), content)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("rotateWriter kept more than max backups: %v", err)
+	}
+}
+
+func Test_rotateWriter_Write_renameFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xferlog")
+
+	// backup path is not empty directory, so rename fails
+	if err := os.MkdirAll(filepath.Join(path+".1", "keep"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newRotateWriter(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("rotateWriter.Write() error = %v", err)
+		}
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first\nsecond\nthird\n" {
+		t.Errorf("rotateWriter file = %q, want all lines in current file", string(got))
+	}
+}
@@ -0,0 +1,211 @@
+package pftp
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// default values of brute force protection
+	defaultMaxLoginFailures = 5
+	defaultFailureWindow    = 600
+	defaultBanTime          = 900
+	defaultLoginDelay       = 1
+	defaultMaxLoginDelay    = 16
+)
+
+// loginFailure is a state of login failures by one client IP or user
+type loginFailure struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	BannedUntil time.Time `json:"banned_until"`
+}
+
+// bruteForceGuard counts login failures per client IP and per user,
+// delays failed responses and bans offenders for a while
+type bruteForceGuard struct {
+	maxFailures int
+	window      time.Duration
+	banTime     time.Duration
+	delay       time.Duration
+	maxDelay    time.Duration
+	storePath   string
+	mutex       sync.Mutex
+	entries     map[string]*loginFailure
+	lastSweep   time.Time
+	now         func() time.Time
+}
+
+func newBruteForceGuard(c *bruteForceConfig) (*bruteForceGuard, error) {
+	g := &bruteForceGuard{
+		maxFailures: c.MaxFailures,
+		window:      time.Duration(c.FailureWindow) * time.Second,
+		banTime:     time.Duration(c.BanTime) * time.Second,
+		delay:       time.Duration(c.Delay) * time.Second,
+		maxDelay:    time.Duration(c.MaxDelay) * time.Second,
+		storePath:   c.StorePath,
+		entries:     make(map[string]*loginFailure),
+		now:         time.Now,
+	}
+
+	if len(g.storePath) > 0 {
+		if err := g.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+func bruteForceKeys(ip string, user string) []string {
+	keys := []string{"ip:" + ip}
+	if len(user) > 0 {
+		keys = append(keys, "user:"+user)
+	}
+
+	return keys
+}
+
+// check client IP or user is banned. empty user checks only client IP
+func (g *bruteForceGuard) isBanned(ip string, user string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.now()
+	for _, key := range bruteForceKeys(ip, user) {
+		if e, ok := g.entries[key]; ok && now.Before(e.BannedUntil) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// count login failure and return delay before response to client.
+// client IP or user is banned when failures reach max failures
+func (g *bruteForceGuard) fail(ip string, user string) time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.now()
+	g.sweep(now)
+
+	failures := 0
+	banned := false
+	for _, key := range bruteForceKeys(ip, user) {
+		e, ok := g.entries[key]
+		if !ok || now.Sub(e.LastFailure) > g.window {
+			e = &loginFailure{}
+			g.entries[key] = e
+		}
+
+		e.Failures++
+		e.LastFailure = now
+		if e.Failures > failures {
+			failures = e.Failures
+		}
+
+		if e.Failures >= g.maxFailures && !now.Before(e.BannedUntil) {
+			e.BannedUntil = now.Add(g.banTime)
+			banned = true
+
+			logrus.Warnf("%s is banned until %s by %d login failures", key, e.BannedUntil.Format(time.RFC3339), e.Failures)
+			metrics.bans.inc(strings.SplitN(key, ":", 2)[0])
+		}
+	}
+
+	if banned && len(g.storePath) > 0 {
+		if err := g.save(); err != nil {
+			logrus.Errorf("cannot save login failures to %s: %v", g.storePath, err)
+		}
+	}
+
+	// double delay by each failure
+	delay := g.delay
+	for i := 1; i < failures && delay < g.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.maxDelay {
+		delay = g.maxDelay
+	}
+
+	return delay
+}
+
+// reset login failures of client IP and user by successful login
+func (g *bruteForceGuard) succeed(ip string, user string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.now()
+	for _, key := range bruteForceKeys(ip, user) {
+		if e, ok := g.entries[key]; ok && !now.Before(e.BannedUntil) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// delete expired entries. must be called with lock
+func (g *bruteForceGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.window {
+		return
+	}
+	g.lastSweep = now
+
+	for key, e := range g.entries {
+		if now.Sub(e.LastFailure) > g.window && !now.Before(e.BannedUntil) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// load entries from store file. not exist file is ignored
+func (g *bruteForceGuard) load() error {
+	b, err := os.ReadFile(g.storePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := json.Unmarshal(b, &g.entries); err != nil {
+		return err
+	}
+	g.sweep(g.now())
+
+	return nil
+}
+
+// save entries to store file. must be called with lock
+func (g *bruteForceGuard) save() error {
+	b, err := json.Marshal(g.entries)
+	if err != nil {
+		return err
+	}
+
+	// replace file atomically
+	tmp := g.storePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, g.storePath)
+}
+
+// Close saves entries to store file
+func (g *bruteForceGuard) Close() error {
+	if len(g.storePath) == 0 {
+		return nil
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.save()
+}
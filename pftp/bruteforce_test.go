@@ -0,0 +1,168 @@
+package pftp
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tevino/abool"
+)
+
+func Test_bruteForceGuard_fail(t *testing.T) {
+	now := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+	g, err := newBruteForceGuard(&bruteForceConfig{
+		MaxFailures:   3,
+		FailureWindow: 600,
+		BanTime:       900,
+		Delay:         1,
+		MaxDelay:      3,
+		StorePath:     filepath.Join(t.TempDir(), "bans.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.now = func() time.Time { return now }
+
+	tests := []struct {
+		name      string
+		ip        string
+		user      string
+		after     time.Duration
+		wantDelay time.Duration
+		wantIP    bool
+		wantUser  bool
+	}{
+		{
+			name:      "first_failure",
+			ip:        "192.168.10.1",
+			user:      "prouser",
+			wantDelay: time.Second,
+		},
+		{
+			name:      "second_failure",
+			ip:        "192.168.10.1",
+			user:      "prouser",
+			wantDelay: 2 * time.Second,
+		},
+		{
+			name:      "ban_by_max_failures",
+			ip:        "192.168.10.1",
+			user:      "prouser",
+			wantDelay: 3 * time.Second,
+			wantIP:    true,
+			wantUser:  true,
+		},
+		{
+			name:      "ban_expired",
+			ip:        "192.168.10.2",
+			user:      "anotheruser",
+			after:     901 * time.Second,
+			wantDelay: time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.after)
+
+			if got := g.fail(tt.ip, tt.user); got != tt.wantDelay {
+				t.Errorf("bruteForceGuard.fail() = %v, want %v", got, tt.wantDelay)
+			}
+			if got := g.isBanned("192.168.10.1", ""); got != tt.wantIP {
+				t.Errorf("bruteForceGuard.isBanned() ip = %v, want %v", got, tt.wantIP)
+			}
+			if got := g.isBanned("192.168.10.3", "prouser"); got != tt.wantUser {
+				t.Errorf("bruteForceGuard.isBanned() user = %v, want %v", got, tt.wantUser)
+			}
+		})
+	}
+}
+
+func Test_bruteForceGuard_load(t *testing.T) {
+	c := &bruteForceConfig{
+		MaxFailures:   1,
+		FailureWindow: 600,
+		BanTime:       900,
+		Delay:         1,
+		MaxDelay:      16,
+		StorePath:     filepath.Join(t.TempDir(), "bans.json"),
+	}
+
+	g, err := newBruteForceGuard(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.fail("192.168.10.1", "prouser")
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// bans are kept after restart
+	restarted, err := newBruteForceGuard(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.isBanned("192.168.10.1", "") || !restarted.isBanned("", "prouser") {
+		t.Errorf("bruteForceGuard.load() did not restore bans: %v", restarted.entries)
+	}
+
+	// successful login does not reset bans
+	restarted.succeed("192.168.10.1", "prouser")
+	if !restarted.isBanned("192.168.10.1", "prouser") {
+		t.Errorf("bruteForceGuard.succeed() reset bans")
+	}
+}
+
+func Test_proxyServer_checkLoginResult(t *testing.T) {
+	tests := []struct {
+		name        string
+		codes       []string
+		wantResults []bool
+		wantWaiting bool
+	}{
+		{
+			name:        "success",
+			codes:       []string{"230"},
+			wantResults: []bool{true},
+		},
+		{
+			name:        "failure",
+			codes:       []string{"530"},
+			wantResults: []bool{false},
+		},
+		{
+			name:        "need_account",
+			codes:       []string{"332"},
+			wantWaiting: true,
+		},
+		{
+			name:  "syntax_error",
+			codes: []string{"501"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var results []bool
+			s := &proxyServer{
+				waitingLogin: abool.NewBool(true),
+				loginResult: func(success bool) time.Duration {
+					results = append(results, success)
+					return 0
+				},
+			}
+
+			for _, code := range tt.codes {
+				s.checkLoginResult(code)
+			}
+
+			if !reflect.DeepEqual(results, tt.wantResults) {
+				t.Errorf("proxyServer.checkLoginResult() results = %v, want %v", results, tt.wantResults)
+			}
+			if s.waitingLogin.IsSet() != tt.wantWaiting {
+				t.Errorf("proxyServer.checkLoginResult() waiting = %v, want %v", s.waitingLogin.IsSet(), tt.wantWaiting)
+			}
+		})
+	}
+}
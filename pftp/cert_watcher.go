@@ -0,0 +1,102 @@
+package pftp
+
+import (
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// certWatchInterval is the interval of checking certificate files update
+	certWatchInterval = 30 * time.Second
+)
+
+// file status for detect file update
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// get status of files. status of not exist file is zero value
+func getFileStats(files []string) map[string]fileStat {
+	stats := make(map[string]fileStat, len(files))
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			stats[f] = fileStat{}
+			continue
+		}
+		stats[f] = fileStat{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	return stats
+}
+
+func fileStatsChanged(before, after map[string]fileStat) bool {
+	for f, b := range before {
+		a := after[f]
+		if !a.modTime.Equal(b.modTime) || a.size != b.size {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch cert, key and CA files and reload them when they are changed on disk.
+// invalid files are not swapped and current certificate is kept.
+func (t *tlsData) watchCertificate(TLS *tlsPair, interval time.Duration) {
+	t.mutex.Lock()
+	if t.stopWatch != nil {
+		t.mutex.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	t.stopWatch = stop
+	t.mutex.Unlock()
+
+	files := []string{TLS.Cert, TLS.Key}
+	if len(TLS.CACert) > 0 {
+		files = append(files, TLS.CACert)
+	}
+	for _, sni := range TLS.SNI {
+		files = append(files, sni.Cert, sni.Key)
+	}
+	stats := getFileStats(files)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				current := getFileStats(files)
+				if !fileStatsChanged(stats, current) {
+					continue
+				}
+				// files may be written one by one. retry on next change
+				stats = current
+
+				logrus.Infof("TLS certificate files of %s are changed. reloading...", TLS.Cert)
+				if err := t.loadCertificate(TLS); err != nil {
+					logrus.Errorf("reload TLS certificate failed. keep current certificate: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop watching certificate files
+func (t *tlsData) stopWatchCertificate() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.stopWatch != nil {
+		close(t.stopWatch)
+		t.stopWatch = nil
+	}
+}
@@ -0,0 +1,103 @@
+package pftp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write self signed certificate and key to files
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if certFile != "" {
+		if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keyFile != "" {
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_tlsData_watchCertificate(t *testing.T) {
+	dir := t.TempDir()
+	pair := &tlsPair{
+		Cert: filepath.Join(dir, "server.crt"),
+		Key:  filepath.Join(dir, "server.key"),
+	}
+	writeTestCertificate(t, pair.Cert, pair.Key, "old.example.com")
+
+	tlsData, err := buildTLSConfigForClient(pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsData.watchCertificate(pair, 10*time.Millisecond)
+	defer tlsData.stopWatchCertificate()
+
+	commonName := func() string {
+		cert, _ := tlsData.getTLSConfig().GetCertificate(&tls.ClientHelloInfo{})
+		return cert.Leaf.Subject.CommonName
+	}
+
+	waitFor := func(want string) string {
+		var got string
+		for i := 0; i < 100; i++ {
+			if got = commonName(); got == want {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return got
+	}
+
+	// rotated certificate is loaded
+	writeTestCertificate(t, pair.Cert, pair.Key, "new.example.com")
+	if got := waitFor("new.example.com"); got != "new.example.com" {
+		t.Errorf("watchCertificate() certificate = %v, want new.example.com", got)
+	}
+
+	// mismatched pair is not loaded
+	writeTestCertificate(t, pair.Cert, "", "invalid.example.com")
+	time.Sleep(100 * time.Millisecond)
+	if got := commonName(); got != "new.example.com" {
+		t.Errorf("watchCertificate() swapped invalid pair. certificate = %v", got)
+	}
+}
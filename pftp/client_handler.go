@@ -2,6 +2,8 @@ package pftp
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -25,6 +27,7 @@ func init() {
 	handlers = make(map[string]*handleFunc)
 	handlers["PROXY"] = &handleFunc{(*clientHandler).handlePROXY, false}
 	handlers["USER"] = &handleFunc{(*clientHandler).handleUSER, true}
+	handlers["PASS"] = &handleFunc{(*clientHandler).handlePASS, false}
 	handlers["AUTH"] = &handleFunc{(*clientHandler).handleAUTH, true}
 	handlers["PBSZ"] = &handleFunc{(*clientHandler).handlePBSZ, true}
 	handlers["PROT"] = &handleFunc{(*clientHandler).handlePROT, true}
@@ -47,10 +50,24 @@ type clientHandler struct {
 	id                  uint64
 	conn                net.Conn
 	config              *config
+	baseConfig          *config
 	tlsDatas            *tlsDataSet
 	controlInTLS        *abool.AtomicBool
 	transferInTLS       *abool.AtomicBool
 	middleware          middleware
+	resolver            OriginResolver
+	auditLog            *auditLogger
+	limiter             *connLimiter
+	limitKeys           map[string]string
+	bruteForce          *bruteForceGuard
+	access              *accessControl
+	pools               *originPools
+	originPool          []string
+	originStrategy      string
+	poolMember          string
+	user                string
+	commandCount        int
+	sessionID           string
 	writer              *bufio.Writer
 	reader              *bufio.Reader
 	line                string
@@ -65,13 +82,25 @@ type clientHandler struct {
 	srcIP               string
 	previousTLSCommands []string
 	inDataTransfer      *abool.AtomicBool
+	closing             *abool.AtomicBool
+	certUser            string
+	userRequireTLS      bool
 }
 
 func newClientHandler(connection net.Conn, c *config, sharedTLSData *tlsData, m middleware, id uint64, currentConnection *int32) *clientHandler {
+	// is masquerade IP not setted, set local IP of client connection.
+	// config of listener is shared by sessions, so it is set to session own copy
+	if len(c.MasqueradeIP) == 0 {
+		sc := *c
+		sc.MasqueradeIP, _, _ = net.SplitHostPort(connection.LocalAddr().String())
+		c = &sc
+	}
+
 	p := &clientHandler{
 		id:                id,
 		conn:              connection,
 		config:            c,
+		baseConfig:        c,
 		controlInTLS:      abool.New(),
 		transferInTLS:     abool.New(),
 		middleware:        m,
@@ -83,18 +112,21 @@ func newClientHandler(connection net.Conn, c *config, sharedTLSData *tlsData, m
 		log:               &logger{fromip: connection.RemoteAddr().String(), user: "-", id: id},
 		srcIP:             connection.RemoteAddr().String(),
 		inDataTransfer:    abool.New(),
+		closing:           abool.New(),
+		limitKeys:         make(map[string]string),
+		sessionID:         newSessionID(),
 	}
 
 	// increase current connection count
 	p.connCounts = atomic.AddInt32(p.currentConnection, 1)
-	p.log.info("FTP Client connected. clientIP: %s. current connection count: %d", p.conn.RemoteAddr(), p.connCounts)
+	p.log.info("FTP Client connected. clientIP: %s. session ID: %s. current connection count: %d", p.conn.RemoteAddr(), p.sessionID, p.connCounts)
 
-	// is masquerade IP not setted, set local IP of client connection
-	if len(p.config.MasqueradeIP) == 0 {
-		p.config.MasqueradeIP = strings.Split(connection.LocalAddr().String(), ":")[0]
+	// make TLS configs by shared pftp server conf(for client) and client own conf(for origin)
+	// client TLS config is made for each session when data connections must resume it
+	if sharedTLSData != nil {
+		sharedTLSData = sharedTLSData.forSession()
 	}
 
-	// make TLS configs by shared pftp server conf(for client) and client own conf(for origin)
 	p.tlsDatas = &tlsDataSet{
 		forClient: sharedTLSData,
 		forOrigin: buildTLSConfigForOrigin(c),
@@ -114,6 +146,38 @@ func (c *clientHandler) Close() error {
 	return nil
 }
 
+// send 421 and close client connection for graceful shutdown
+func (c *clientHandler) closeIdle() {
+	if !c.closing.SetToIf(false, true) {
+		return
+	}
+
+	r := result{
+		code: 421,
+		msg:  "Service not available, closing control connection",
+	}
+
+	// do not block draining other sessions by stalled client
+	c.conn.SetWriteDeadline(time.Now().Add(drainWriteTimeout))
+	if err := r.Response(c); err != nil {
+		c.log.debug("cannot send shutdown message to client: %s", err.Error())
+	}
+
+	c.log.info("close idle connection by shutdown")
+	connectionCloser(c, c.log)
+}
+
+// close client and origin connections immediately
+func (c *clientHandler) forceClose() {
+	c.closing.Set()
+
+	c.log.info("close connection by shutdown deadline")
+	connectionCloser(c, c.log)
+	if c.proxy != nil {
+		connectionCloser(c.proxy, c.log)
+	}
+}
+
 func (c *clientHandler) setClientDeadLine(t int) {
 	// do not time out during transfer data
 	if c.inDataTransfer.IsSet() {
@@ -133,28 +197,63 @@ func (c *clientHandler) handleCommands() error {
 		if c.proxy != nil {
 			connectionCloser(c.proxy, c.log)
 		}
+
+		c.releaseLimits()
+		c.pools.release(c.poolMember)
 	}()
 
-	// Check max client. If exceeded, send 530 error to client and disconnect
-	if c.connCounts > c.config.MaxConnections {
-		err := fmt.Errorf("exceeded client connection limit")
-		r := result{
-			code: 530,
-			msg:  "max client exceeded",
-			err:  err,
-			log:  c.log,
-		}
-		if err := r.Response(c); err != nil {
+	// Check client IP is permitted, not banned and connections are not exceeded before
+	// implicit TLS handshake, because rejected clients should not cost handshake
+	if r := c.checkConnection(); r != nil {
+		// implicit TLS client cannot read cleartext response, so only disconnect
+		if c.config.ImplicitTLS {
+			c.log.err("connection rejected before TLS handshake: %s", r.err)
+		} else if err := r.Response(c); err != nil {
 			c.log.err("cannot send response to client")
 		}
 
-		return err
+		return r.err
+	}
+
+	// implicit TLS client expects TLS handshake before welcome message
+	if c.config.ImplicitTLS {
+		if err := c.handleImplicitTLS(); err != nil {
+			return err
+		}
 	}
 
 	eg := errgroup.Group{}
 
 	err := c.connectProxy()
 	if err != nil {
+		var r *result
+
+		// origin certificate is not trusted
+		if isOriginVerifyError(err) {
+			r = &result{
+				code: 421,
+				msg:  "Service not available, origin server certificate verification failed",
+				err:  err,
+				log:  c.log,
+			}
+		}
+
+		// all origins reached connection limit
+		if errors.Is(err, errOriginConnLimit) {
+			r = &result{
+				code: 421,
+				msg:  "Too many connections to origin server",
+				err:  err,
+				log:  c.log,
+			}
+		}
+
+		if r != nil {
+			if err := r.Response(c); err != nil {
+				c.log.err("cannot send response to client")
+			}
+		}
+
 		return err
 	}
 
@@ -175,6 +274,152 @@ func (c *clientHandler) handleCommands() error {
 	return err
 }
 
+// check connection is acceptable before greeting. max client exceeded gets 530,
+// and denied or banned client IP and exceeded connections per IP get 421
+func (c *clientHandler) checkConnection() *result {
+	if c.connCounts > c.config.MaxConnections {
+		return &result{
+			code: 530,
+			msg:  "max client exceeded",
+			err:  fmt.Errorf("exceeded client connection limit"),
+			log:  c.log,
+		}
+	}
+
+	if r := c.checkAccess(); r != nil {
+		return r
+	}
+	if r := c.checkBanned(); r != nil {
+		return r
+	}
+
+	return c.checkConnectLimits()
+}
+
+// check client IP is permitted by access lists
+func (c *clientHandler) checkAccess() *result {
+	if c.access.permit(c.clientIP()) {
+		return nil
+	}
+
+	return &result{
+		code: 421,
+		msg:  "Access denied from your IP address",
+		err:  fmt.Errorf("client IP %s is denied by access list", c.clientIP()),
+		log:  c.log,
+	}
+}
+
+// check client IP is banned by login failures
+func (c *clientHandler) checkBanned() *result {
+	if c.bruteForce == nil || !c.bruteForce.isBanned(c.clientIP(), "") {
+		return nil
+	}
+
+	return &result{
+		code: 421,
+		msg:  "Too many login failures from your IP address",
+		err:  fmt.Errorf("client IP %s is banned by login failures", c.clientIP()),
+		log:  c.log,
+	}
+}
+
+// count login result by client IP and user, and get delay before response to client
+func (c *clientHandler) loginResult(success bool) time.Duration {
+	if c.bruteForce == nil {
+		return 0
+	}
+
+	if success {
+		c.bruteForce.succeed(c.clientIP(), c.user)
+		return 0
+	}
+
+	c.log.info("login failed")
+	return c.bruteForce.fail(c.clientIP(), c.user)
+}
+
+// count connection of the user when origin accepted login.
+// user is not counted before login, so USER only can not lock out the user
+func (c *clientHandler) acceptLogin() error {
+	if !c.acquireLimit(limitByUser, c.user, c.config.MaxConnsPerUser) {
+		return fmt.Errorf("%w %s", errUserConnLimit, c.user)
+	}
+
+	return nil
+}
+
+// check connection limit of client IP before connect to origin.
+// origin is counted by connectProxy because pool member is decided on connect
+func (c *clientHandler) checkConnectLimits() *result {
+	if !c.acquireLimit(limitByIP, c.clientIP(), c.config.MaxConnsPerIP) {
+		return &result{
+			code: 421,
+			msg:  "Too many connections from your IP address",
+			err:  fmt.Errorf("exceeded connection limit of client IP %s", c.clientIP()),
+			log:  c.log,
+		}
+	}
+
+	return nil
+}
+
+// make TLS connection with client before send welcome message
+func (c *clientHandler) handleImplicitTLS() error {
+	if c.tlsDatas.forClient == nil || c.tlsDatas.forClient.getTLSConfig() == nil {
+		return fmt.Errorf("cannot get a TLS config for implicit TLS")
+	}
+
+	tlsConn := tls.Server(c.conn, c.tlsDatas.forClient.getTLSConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		metrics.tlsHandshakeFails.inc("client")
+		return fmt.Errorf("TLS handshake with client has failed: %v", err)
+	}
+
+	c.setClientTLSConn(tlsConn)
+
+	// implicit TLS client never send AUTH, PBSZ and PROT before login,
+	// so make commands for negotiate TLS with origin by ourselves.
+	// AUTH is skipped by sendTLSCommand when origin uses implicit TLS,
+	// because it is decided by each origin.
+	c.previousTLSCommands = append(c.previousTLSCommands, "AUTH TLS\r\n", "PBSZ 0\r\n", "PROT P\r\n")
+	c.transferInTLS.Set()
+
+	return nil
+}
+
+// replace client connection to TLS connection and
+// set client TLS informations to origin TLS config
+func (c *clientHandler) setClientTLSConn(tlsConn *tls.Conn) {
+	c.log.debug("TLS control connection finished with client. TLS protocol version: %s and Cipher Suite: %s", getTLSProtocolName(tlsConn.ConnectionState().Version), tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite))
+
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(c.conn)
+	c.writer = bufio.NewWriter(c.conn)
+
+	// if proxy server attached, change proxy handler's client reader & writer to TLS conn
+	if c.proxy != nil {
+		c.proxy.clientReader = c.reader
+		c.proxy.clientWriter = c.writer
+	}
+
+	c.controlInTLS.Set()
+
+	c.tlsDatas.serverName = tlsConn.ConnectionState().ServerName
+	c.context.ServerName = c.tlsDatas.serverName
+
+	// client certificate is already verified by verifyTLSConnection
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 && c.config.TLS != nil {
+		c.context.ClientCertificate = certs[0]
+		c.certUser = getClientCertUser(certs[0], c.config.TLS.ClientCertUser)
+		c.log.debug("client certificate user: %s", c.certUser)
+	}
+
+	// pass SNI of client to origin. TLS version and cipher suite
+	// with origin are decided by origin own settings
+	c.tlsDatas.forOrigin.setServerName(c.tlsDatas.serverName)
+}
+
 func (c *clientHandler) getResponseFromOrigin() error {
 	var err error
 
@@ -326,6 +571,7 @@ func (c *clientHandler) writeMessage(code int, message string) error {
 
 func (c *clientHandler) handleCommand(line string) (r *result) {
 	c.parseLine(line)
+	c.commandCount++
 	defer func() {
 		if r := recover(); r != nil {
 			r = &result{
@@ -336,6 +582,7 @@ func (c *clientHandler) handleCommand(line string) (r *result) {
 	}()
 
 	c.commandLog(line)
+	metrics.commands.inc(commandLabel(c.command))
 
 	if c.middleware[c.command] != nil {
 		if err := c.middleware[c.command](c.context, c.param); err != nil {
@@ -369,8 +616,18 @@ func (c *clientHandler) handleCommand(line string) (r *result) {
 }
 
 func (c *clientHandler) connectProxy() error {
+	origins, err := c.originsUnderLimit(c.originCandidates())
+	if err != nil {
+		return err
+	}
+
+	// apply origin own settings of first candidate until connected
+	if len(origins) > 0 {
+		c.config = origins[0].config
+	}
+
 	if c.proxy != nil {
-		err := c.proxy.switchOrigin(c.srcIP, c.context.RemoteAddr, c.previousTLSCommands)
+		err := c.proxy.switchOrigin(c.srcIP, origins, c.originTLSCommands())
 		if err != nil {
 			return err
 		}
@@ -380,11 +637,14 @@ func (c *clientHandler) connectProxy() error {
 				clientReader:   c.reader,
 				clientWriter:   c.writer,
 				tlsDatas:       c.tlsDatas,
-				originAddr:     c.context.RemoteAddr,
+				origins:        origins,
 				mutex:          c.mutex,
 				log:            c.log,
-				config:         c.config,
 				inDataTransfer: c.inDataTransfer,
+				loginResult:    c.loginResult,
+				acceptLogin:    c.acceptLogin,
+				proxyTLVs:      c.proxyTLVs,
+				pools:          c.pools,
 			})
 		if err != nil {
 			return err
@@ -392,9 +652,104 @@ func (c *clientHandler) connectProxy() error {
 		c.proxy = p
 	}
 
+	// apply settings of connected origin
+	c.config = c.proxy.config
+
+	// count connections of connected origin, not pool name
+	if !c.acquireLimit(limitByOrigin, c.proxy.originAddr, c.config.MaxConnsOrigin) {
+		return fmt.Errorf("%w %s", errOriginConnLimit, c.proxy.originAddr)
+	}
+
+	// count sessions of each member for least connections
+	c.pools.release(c.poolMember)
+	c.poolMember = c.proxy.originMember
+	c.pools.acquire(c.poolMember)
+
+	if c.isPoolTarget() {
+		c.log.info("origin %s is selected from pool %s by %s", c.proxy.originMember, c.context.RemoteAddr, c.pools.strategy(c.context.RemoteAddr, c.originStrategy))
+	}
+
 	return nil
 }
 
+// get origins to connect in order of failover.
+// Context.RemoteAddr is address or name of origin or pool
+func (c *clientHandler) originCandidates() []*originCandidate {
+	if len(c.context.RemoteAddr) == 0 && len(c.originPool) == 0 {
+		return nil
+	}
+
+	addrs := c.pools.resolve(c.context.RemoteAddr, c.originPool, c.originStrategy, c.user)
+	origins := make([]*originCandidate, 0, len(addrs))
+	for _, addr := range addrs {
+		originConfig, originAddr := c.baseConfig.forOrigin(addr)
+		origins = append(origins, &originCandidate{member: addr, addr: originAddr, config: originConfig})
+	}
+
+	return origins
+}
+
+// check origin is selected from [[pool]] or pool returned by resolver
+func (c *clientHandler) isPoolTarget() bool {
+	return len(c.originPool) > 0 || c.pools.poolConfig(c.context.RemoteAddr) != nil
+}
+
+// skip origins which reached max_connections_per_origin, so that
+// next member of pool is connected
+func (c *clientHandler) originsUnderLimit(origins []*originCandidate) ([]*originCandidate, error) {
+	available := make([]*originCandidate, 0, len(origins))
+	for _, o := range origins {
+		if c.underLimit(limitByOrigin, o.addr, o.config.MaxConnsOrigin) {
+			available = append(available, o)
+		}
+	}
+
+	if len(origins) > 0 && len(available) == 0 {
+		return nil, fmt.Errorf("%w %s", errOriginConnLimit, c.context.RemoteAddr)
+	}
+
+	return available, nil
+}
+
+// commands for make TLS connection with origin.
+// when force origin TLS, origin always uses TLS on control connection
+// and on data connection too if data channel is proxied
+func (c *clientHandler) originTLSCommands() []string {
+	if !c.config.ForceOriginTLS {
+		return c.previousTLSCommands
+	}
+
+	commands := []string{"AUTH TLS\r\n", "PBSZ 0\r\n"}
+	if c.config.DataChanProxy {
+		return append(commands, "PROT P\r\n")
+	}
+
+	// client and origin connect data channel directly,
+	// so origin must use the protection level of client
+	for _, cmd := range c.previousTLSCommands {
+		if strings.EqualFold(getCommand(cmd)[0], "PROT") {
+			commands = append(commands, cmd)
+		}
+	}
+
+	return commands
+}
+
+// PBSZ and PROT of client are answered by pftp and not sent to origin
+func (c *clientHandler) originTLSByProxy() bool {
+	return c.config.ForceOriginTLS && c.config.DataChanProxy
+}
+
+// check TLS is required by listener or user
+func (c *clientHandler) requireTLS() bool {
+	return c.config.RequireTLS || c.userRequireTLS
+}
+
+// client certificate is requested on TLS handshake
+func (c *clientHandler) clientCertAuth() bool {
+	return c.config.TLS != nil && (c.config.TLS.ClientAuth == clientAuthOptional || c.config.TLS.ClientAuth == clientAuthRequired)
+}
+
 // Get command from command line
 func getCommand(line string) []string {
 	return strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/tls"
 	"errors"
+	"io"
 	"net"
 	"strings"
 	"testing"
@@ -104,7 +105,6 @@ func Test_clientHandler_handleCommand(t *testing.T) {
 	}
 	type want struct {
 		result *result
-		srcIP  string
 	}
 
 	tests := []struct {
@@ -139,8 +139,8 @@ func Test_clientHandler_handleCommand(t *testing.T) {
 			want: want{
 				result: &result{
 					code: 500,
-					msg:  "Proxy header parse error",
-					err:  errors.New("wrong proxy header parameters"),
+					msg:  "Proxy header not accepted",
+					err:  errors.New("proxy header is accepted only before greeting"),
 				},
 			},
 		},
@@ -158,13 +158,13 @@ func Test_clientHandler_handleCommand(t *testing.T) {
 			want: want{
 				result: &result{
 					code: 500,
-					msg:  "Proxy header parse error",
-					err:  errors.New("wrong source ip address"),
+					msg:  "Proxy header not accepted",
+					err:  errors.New("proxy header is accepted only before greeting"),
 				},
 			},
 		},
 		{
-			name: "proxy_ok",
+			name: "proxy_not_accepted",
 			fields: fields{
 				config: &config{
 					IdleTimeout: 5,
@@ -175,7 +175,11 @@ func Test_clientHandler_handleCommand(t *testing.T) {
 				line: "PROXY TCP4 192.168.10.1 100.100.100.100 12345 21\r\n",
 			},
 			want: want{
-				srcIP: "192.168.10.1:12345",
+				result: &result{
+					code: 500,
+					msg:  "Proxy header not accepted",
+					err:  errors.New("proxy header is accepted only before greeting"),
+				},
 			},
 		},
 	}
@@ -203,8 +207,6 @@ func Test_clientHandler_handleCommand(t *testing.T) {
 			got := clientHandler.handleCommand(tt.args.line)
 			if (got != nil && tt.want.result == nil) || (tt.want.result != nil && (got.code != tt.want.result.code || got.msg != tt.want.result.msg || got.err.Error() != tt.want.result.err.Error())) {
 				t.Errorf("clientHandler.handleCommand() = %v, want %v", got, tt.want.result)
-			} else if tt.name == "proxy_ok" && clientHandler.srcIP != tt.want.srcIP {
-				t.Errorf("clientHandler.sourceIP = %v, want %v", clientHandler.srcIP, tt.want.srcIP)
 			}
 		})
 	}
@@ -552,3 +554,46 @@ func Test_clientHandler_TLS_Session_Resumption(t *testing.T) {
 	server.Close()
 	<-done
 }
+
+func Test_clientHandler_handleCommands_reject(t *testing.T) {
+	access, err := newAccessControl(&accessConfig{Deny: []string{"127.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		implicitTLS bool
+		want        string
+	}{
+		{
+			name: "cleartext",
+			want: "421 Access denied from your IP address\r\n",
+		},
+		{
+			// rejected before TLS handshake without response
+			name:        "implicit_tls",
+			implicitTLS: true,
+			want:        "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := acceptTestConn(t)
+
+			c := newClientHandler(serverConn, &config{ImplicitTLS: tt.implicitTLS, MaxConnections: 10}, nil, nil, 1, new(int32))
+			c.access = access
+
+			if err := c.handleCommands(); err == nil {
+				t.Errorf("clientHandler.handleCommands() error = nil, want error")
+			}
+
+			clientConn.SetReadDeadline(time.Now().Add(time.Second))
+			got, _ := io.ReadAll(clientConn)
+			if string(got) != tt.want {
+				t.Errorf("clientHandler.handleCommands() sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
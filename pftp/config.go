@@ -1,6 +1,8 @@
 package pftp
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"strconv"
@@ -9,6 +11,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/BurntSushi/toml"
+	proxyproto "github.com/pires/go-proxyproto"
 )
 
 const (
@@ -24,6 +27,11 @@ type config struct {
 	ProxyTimeout    int      `toml:"proxy_timeout"`
 	TransferTimeout int      `toml:"transfer_timeout"`
 	MaxConnections  int32    `toml:"max_connections"`
+	MaxConnsPerIP   int32    `toml:"max_connections_per_ip"`
+	MaxConnsPerUser int32    `toml:"max_connections_per_user"`
+	MaxConnsOrigin  int32    `toml:"max_connections_per_origin"`
+	TrustedProxies  []string `toml:"trusted_proxies"`
+	ProxyHeaderTime int      `toml:"proxy_header_timeout"`
 	ProxyProtocol   bool     `toml:"send_proxy_protocol"`
 	WelcomeMsg      string   `toml:"welcome_message"`
 	KeepaliveTime   int      `toml:"keepalive_time"`
@@ -32,7 +40,361 @@ type config struct {
 	MasqueradeIP    string   `toml:"masquerade_ip"`
 	TransferMode    string   `toml:"transfer_mode"`
 	IgnorePassiveIP bool     `toml:"ignore_passive_ip"`
+	ImplicitTLS     bool     `toml:"implicit_tls"`
+	OriginImplicit  bool     `toml:"origin_implicit_tls"`
+	RequireTLS      bool     `toml:"require_tls"`
+	ForceOriginTLS  bool     `toml:"force_origin_tls"`
+	MetricsAddr     string   `toml:"metrics_listen_addr"`
+	ShutdownTimeout int      `toml:"shutdown_timeout"`
 	TLS             *tlsPair `toml:"tls"`
+
+	// trusted_proxies parsed by validateConfig
+	trustedProxyNets []*net.IPNet
+
+	// origin own settings applied by forOrigin
+	passiveIP             string
+	proxyVersion          int
+	proxyProtocolExplicit bool
+
+	Listeners   []*listenerConfig  `toml:"listener"`
+	Origins     []*originConfig    `toml:"origin"`
+	Pools       []*poolConfig      `toml:"pool"`
+	Resolver    *resolverConfig    `toml:"resolver"`
+	AuditLog    *auditLogConfig    `toml:"audit_log"`
+	OriginTLS   *originTLSConfig   `toml:"origin_tls"`
+	BruteForce  *bruteForceConfig  `toml:"brute_force"`
+	Access      *accessConfig      `toml:"access"`
+	ProxyHeader *proxyHeaderConfig `toml:"proxy_protocol"`
+}
+
+// originConfig is a settings of one origin selected by address or name.
+// Empty parameters are inherited from global settings.
+type originConfig struct {
+	Name            string           `toml:"name"`
+	Addr            string           `toml:"addr"`
+	ProxyProtocol   *int             `toml:"proxy_protocol"`
+	TransferMode    string           `toml:"transfer_mode"`
+	IgnorePassiveIP *bool            `toml:"ignore_passive_ip"`
+	PassiveIP       string           `toml:"passive_ip"`
+	ImplicitTLS     *bool            `toml:"implicit_tls"`
+	ProxyTimeout    int              `toml:"proxy_timeout"`
+	TransferTimeout int              `toml:"transfer_timeout"`
+	MaxConnections  int32            `toml:"max_connections"`
+	TLS             *originTLSConfig `toml:"tls"`
+}
+
+// find origin settings by address or name
+func (c *config) findOrigin(target string) *originConfig {
+	for _, o := range c.Origins {
+		if o.Addr == target || (len(o.Name) > 0 && o.Name == target) {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// make origin own config from global config and get address of origin.
+// target is address or name of origin
+func (c *config) forOrigin(target string) (*config, string) {
+	o := c.findOrigin(target)
+	if o == nil {
+		return c, target
+	}
+
+	oc := *c
+
+	if o.ProxyProtocol != nil {
+		oc.ProxyProtocol = *o.ProxyProtocol > 0
+		oc.proxyVersion = *o.ProxyProtocol
+		oc.proxyProtocolExplicit = true
+	}
+	if len(o.TransferMode) > 0 {
+		oc.TransferMode = o.TransferMode
+	}
+	if o.IgnorePassiveIP != nil {
+		oc.IgnorePassiveIP = *o.IgnorePassiveIP
+	}
+	if len(o.PassiveIP) > 0 {
+		oc.passiveIP = o.PassiveIP
+	}
+	if o.ImplicitTLS != nil {
+		oc.OriginImplicit = *o.ImplicitTLS
+	}
+	if o.ProxyTimeout > 0 {
+		oc.ProxyTimeout = o.ProxyTimeout
+	}
+	if o.TransferTimeout > 0 {
+		oc.TransferTimeout = o.TransferTimeout
+	}
+	if o.MaxConnections > 0 {
+		oc.MaxConnsOrigin = o.MaxConnections
+	}
+
+	return &oc, o.Addr
+}
+
+// "500 PROXY" response is ignored when proxy protocol is not set for each origin,
+// because some origins may not understand it
+func (c *config) ignoreProxyError() bool {
+	return c.ProxyProtocol && !c.proxyProtocolExplicit
+}
+
+// originTLSConfig is a policy of verifying origin server certificates.
+// [[origin_tls.origin]] overrides it for each origin address, but it is deprecated
+// and [origin.tls] of the same address is used instead of it.
+type originTLSConfig struct {
+	Addr       string   `toml:"addr"`
+	CACert     string   `toml:"ca_cert"`
+	ServerName string   `toml:"server_name"`
+	Pins       []string `toml:"pins"`
+	Insecure   bool     `toml:"insecure"`
+	ClientCert string   `toml:"client_cert"`
+	ClientKey  string   `toml:"client_key"`
+
+	// TLS parameters to origin. if not set, [tls] settings are used
+	MinProtocol string `toml:"min_protocol"`
+	MaxProtocol string `toml:"max_protocol"`
+	CipherSuite string `toml:"cipher_suite"`
+
+	Origins []*originTLSConfig `toml:"origin"`
+}
+
+// make origin own policy from global policy
+func (o *originTLSConfig) forOrigin(origin *originTLSConfig) *originTLSConfig {
+	oc := *o
+	oc.Origins = nil
+
+	oc.Addr = origin.Addr
+	oc.Insecure = o.Insecure || origin.Insecure
+
+	if len(origin.CACert) > 0 {
+		oc.CACert = origin.CACert
+	}
+	if len(origin.ServerName) > 0 {
+		oc.ServerName = origin.ServerName
+	}
+	if len(origin.Pins) > 0 {
+		oc.Pins = origin.Pins
+	}
+	if len(origin.ClientCert) > 0 {
+		oc.ClientCert = origin.ClientCert
+		oc.ClientKey = origin.ClientKey
+	}
+	if len(origin.MinProtocol) > 0 {
+		oc.MinProtocol = origin.MinProtocol
+	}
+	if len(origin.MaxProtocol) > 0 {
+		oc.MaxProtocol = origin.MaxProtocol
+	}
+	if len(origin.CipherSuite) > 0 {
+		oc.CipherSuite = origin.CipherSuite
+	}
+
+	return &oc
+}
+
+// auditLogConfig is a settings of per transfer audit log
+type auditLogConfig struct {
+	Path       string `toml:"path"`
+	Format     string `toml:"format"`
+	MaxSize    int    `toml:"max_size"`
+	MaxBackups int    `toml:"max_backups"`
+}
+
+// proxyHeaderConfig is a settings of PROXY protocol header sent to origin.
+// [[proxy_protocol.origin]] overrides version for each origin address, but it is deprecated
+// and proxy_protocol of [[origin]] is used first.
+type proxyHeaderConfig struct {
+	Version int                  `toml:"version"`
+	UserTLV int                  `toml:"user_tlv"`
+	Origins []*proxyHeaderOrigin `toml:"origin"`
+}
+
+// proxyHeaderOrigin is a PROXY protocol version of one origin
+type proxyHeaderOrigin struct {
+	Addr    string `toml:"addr"`
+	Version int    `toml:"version"`
+}
+
+const (
+	// defaultUserTLV is the default custom TLV type of user name in PROXY protocol v2 header
+	defaultUserTLV = 0xE1
+)
+
+// get PROXY protocol version sent to origin
+func (c *config) proxyProtocolVersion(addr string) int {
+	if c.proxyVersion > 0 {
+		return c.proxyVersion
+	}
+
+	if c.ProxyHeader == nil {
+		return 1
+	}
+
+	for _, o := range c.ProxyHeader.Origins {
+		if o.Addr == addr && o.Version > 0 {
+			return o.Version
+		}
+	}
+
+	if c.ProxyHeader.Version > 0 {
+		return c.ProxyHeader.Version
+	}
+
+	return 1
+}
+
+// get custom TLV type of user name
+func (c *config) proxyUserTLV() proxyproto.PP2Type {
+	if c.ProxyHeader == nil || c.ProxyHeader.UserTLV == 0 {
+		return defaultUserTLV
+	}
+
+	return proxyproto.PP2Type(c.ProxyHeader.UserTLV)
+}
+
+// accessConfig is a CIDR lists of client IP addresses.
+// [[access.user]] adds rules for each user.
+type accessConfig struct {
+	Allow []string            `toml:"allow"`
+	Deny  []string            `toml:"deny"`
+	Users []*accessUserConfig `toml:"user"`
+}
+
+// accessUserConfig is a CIDR lists of one user
+type accessUserConfig struct {
+	Name  string   `toml:"name"`
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+// bruteForceConfig is a settings of login failure protection
+type bruteForceConfig struct {
+	MaxFailures   int    `toml:"max_failures"`
+	FailureWindow int    `toml:"failure_window"`
+	BanTime       int    `toml:"ban_time"`
+	Delay         int    `toml:"delay"`
+	MaxDelay      int    `toml:"max_delay"`
+	StorePath     string `toml:"store_path"`
+}
+
+// poolConfig is a group of origins which can serve same users.
+// name of pool can be used as origin address
+type poolConfig struct {
+	Name                string   `toml:"name"`
+	Members             []string `toml:"members"`
+	Strategy            string   `toml:"strategy"`
+	Weights             []int    `toml:"weights"`
+	HealthCheckInterval int      `toml:"health_check_interval"`
+	HealthCheckTimeout  int      `toml:"health_check_timeout"`
+	HealthCheckProbe    string   `toml:"health_check_probe"`
+	HealthCheckUser     string   `toml:"health_check_user"`
+	HealthCheckPassword string   `toml:"health_check_password"`
+	HealthyThreshold    int      `toml:"healthy_threshold"`
+	UnhealthyThreshold  int      `toml:"unhealthy_threshold"`
+	MaxDialFailures     int      `toml:"max_dial_failures"`
+	EjectionTime        int      `toml:"ejection_time"`
+}
+
+// resolverConfig is a settings of origin resolver
+type resolverConfig struct {
+	Type             string `toml:"type"`
+	Addr             string `toml:"addr"`
+	URI              string `toml:"uri"`
+	Path             string `toml:"path"`
+	SRVName          string `toml:"srv_name"`
+	Timeout          int    `toml:"timeout"`
+	CacheTTL         int    `toml:"cache_ttl"`
+	NegativeCacheTTL int    `toml:"negative_cache_ttl"`
+	StaleTTL         int    `toml:"stale_ttl"`
+}
+
+const (
+	// defaultResolverTimeout is the default request timeout(seconds) of web api and SRV resolver
+	defaultResolverTimeout = 10
+	// defaultProxyHeaderTimeout is the default timeout(seconds) of reading PROXY protocol header
+	defaultProxyHeaderTimeout = 10
+)
+
+// listenerConfig is a per listener settings. Empty parameters
+// are inherited from global settings.
+type listenerConfig struct {
+	ListenAddr     string   `toml:"listen_addr"`
+	WelcomeMsg     string   `toml:"welcome_message"`
+	MasqueradeIP   string   `toml:"masquerade_ip"`
+	MaxConnections int32    `toml:"max_connections"`
+	ImplicitTLS    bool     `toml:"implicit_tls"`
+	RequireTLS     bool     `toml:"require_tls"`
+	DisableTLS     bool     `toml:"disable_tls"`
+	TLS            *tlsPair `toml:"tls"`
+}
+
+// make listener own config from global config
+func (c *config) forListener(l *listenerConfig) *config {
+	lc := *c
+	lc.Listeners = nil
+
+	lc.ListenAddr = l.ListenAddr
+	lc.ImplicitTLS = l.ImplicitTLS
+	lc.RequireTLS = c.RequireTLS || l.RequireTLS
+
+	if len(l.WelcomeMsg) > 0 {
+		lc.WelcomeMsg = l.WelcomeMsg
+	}
+	if len(l.MasqueradeIP) > 0 {
+		lc.MasqueradeIP = l.MasqueradeIP
+	}
+	if l.MaxConnections > 0 {
+		lc.MaxConnections = l.MaxConnections
+	}
+	if l.TLS != nil {
+		lc.TLS = l.TLS
+	}
+	if l.DisableTLS {
+		lc.TLS = nil
+	}
+
+	return &lc
+}
+
+// make new config which has the live changeable settings of n.
+// other settings are kept because they need restart.
+func (c *config) reloaded(n *config) *config {
+	rc := *c
+
+	rc.IdleTimeout = n.IdleTimeout
+	rc.ProxyTimeout = n.ProxyTimeout
+	rc.TransferTimeout = n.TransferTimeout
+	rc.KeepaliveTime = n.KeepaliveTime
+	rc.MaxConnections = n.MaxConnections
+	rc.MaxConnsPerIP = n.MaxConnsPerIP
+	rc.MaxConnsPerUser = n.MaxConnsPerUser
+	rc.MaxConnsOrigin = n.MaxConnsOrigin
+	rc.TrustedProxies = n.TrustedProxies
+	rc.trustedProxyNets = n.trustedProxyNets
+	rc.ProxyHeaderTime = n.ProxyHeaderTime
+	rc.WelcomeMsg = n.WelcomeMsg
+	rc.TLS = n.TLS
+	rc.DataPortRange = n.DataPortRange
+	rc.MasqueradeIP = n.MasqueradeIP
+
+	return &rc
+}
+
+// get each listener's config. if listeners are not set,
+// return global config as a only one listener
+func (c *config) listenerConfigs() []*config {
+	if len(c.Listeners) == 0 {
+		return []*config{c}
+	}
+
+	configs := make([]*config, 0, len(c.Listeners))
+	for _, l := range c.Listeners {
+		configs = append(configs, c.forListener(l))
+	}
+
+	return configs
 }
 
 // NewConfig creates a new config instance and applies the provided options.
@@ -65,30 +427,453 @@ func validateConfig(c *config) error {
 	}
 
 	// validate Transfer mode config
-	c.TransferMode = strings.ToUpper(c.TransferMode)
-	switch c.TransferMode {
+	mode, err := normalizeTransferMode(c.TransferMode)
+	if err != nil {
+		return err
+	}
+	c.TransferMode = mode
+
+	// validate connection limits
+	if c.MaxConnsPerIP < 0 || c.MaxConnsPerUser < 0 || c.MaxConnsOrigin < 0 {
+		return fmt.Errorf("configuration error: max connections per ip, user and origin must not be negative")
+	}
+
+	// validate trusted load balancers
+	trustedProxyNets, err := parseCIDRList(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("configuration error: trusted_proxies is wrong: %v", err)
+	}
+	c.trustedProxyNets = trustedProxyNets
+	if c.ProxyHeaderTime <= 0 {
+		c.ProxyHeaderTime = defaultProxyHeaderTimeout
+	}
+
+	// validate SNI certificates
+	if err := validateTLSPair(c.TLS); err != nil {
+		return err
+	}
+
+	// validate implicit TLS config
+	if len(c.Listeners) == 0 && c.ImplicitTLS && c.TLS == nil {
+		return fmt.Errorf("configuration error: implicit TLS needs tls config")
+	}
+
+	// validate TLS required config
+	if len(c.Listeners) == 0 && c.RequireTLS && c.TLS == nil {
+		return fmt.Errorf("configuration error: require_tls needs tls config")
+	}
+
+	// validate origin resolver config
+	if c.Resolver != nil {
+		if c.Resolver.Timeout <= 0 {
+			c.Resolver.Timeout = defaultResolverTimeout
+		}
+		if c.Resolver.CacheTTL < 0 || c.Resolver.NegativeCacheTTL < 0 || c.Resolver.StaleTTL < 0 {
+			return fmt.Errorf("configuration error: resolver cache ttl must not be negative")
+		}
+
+		switch strings.ToLower(c.Resolver.Type) {
+		case "static":
+		case "webapi":
+			if len(c.Resolver.URI) == 0 {
+				return fmt.Errorf("configuration error: webapi resolver needs uri")
+			}
+		case "file":
+			if len(c.Resolver.Path) == 0 {
+				return fmt.Errorf("configuration error: file resolver needs path")
+			}
+		case "srv":
+			if len(c.Resolver.SRVName) == 0 {
+				return fmt.Errorf("configuration error: srv resolver needs srv_name")
+			}
+		default:
+			return fmt.Errorf("configuration error: resolver type %s is unknown", c.Resolver.Type)
+		}
+	}
+
+	// validate audit log config
+	if c.AuditLog != nil {
+		if len(c.AuditLog.Path) == 0 {
+			return fmt.Errorf("configuration error: audit log needs path")
+		}
+
+		c.AuditLog.Format = strings.ToLower(c.AuditLog.Format)
+		switch c.AuditLog.Format {
+		case "":
+			c.AuditLog.Format = auditFormatXferlog
+		case auditFormatXferlog, auditFormatJSON:
+		default:
+			return fmt.Errorf("configuration error: audit log format %s is unknown", c.AuditLog.Format)
+		}
+	}
+
+	// validate brute force protection config
+	if c.BruteForce != nil {
+		b := c.BruteForce
+		if b.MaxFailures < 0 || b.FailureWindow < 0 || b.BanTime < 0 || b.Delay < 0 || b.MaxDelay < 0 {
+			return fmt.Errorf("configuration error: brute force settings must not be negative")
+		}
+		if b.MaxFailures == 0 {
+			b.MaxFailures = defaultMaxLoginFailures
+		}
+		if b.FailureWindow == 0 {
+			b.FailureWindow = defaultFailureWindow
+		}
+		if b.BanTime == 0 {
+			b.BanTime = defaultBanTime
+		}
+		if b.Delay == 0 {
+			b.Delay = defaultLoginDelay
+		}
+		if b.MaxDelay == 0 {
+			b.MaxDelay = defaultMaxLoginDelay
+		}
+		if b.MaxDelay < b.Delay {
+			return fmt.Errorf("configuration error: brute force max_delay must not be less than delay")
+		}
+	}
+
+	// validate PROXY protocol header config
+	if c.ProxyHeader != nil {
+		if len(c.ProxyHeader.Origins) > 0 {
+			logrus.Warn("[[proxy_protocol.origin]] is deprecated. use proxy_protocol of [[origin]] which takes precedence over it")
+		}
+
+		versions := []int{c.ProxyHeader.Version}
+		for _, o := range c.ProxyHeader.Origins {
+			if len(o.Addr) == 0 {
+				return fmt.Errorf("configuration error: proxy_protocol.origin needs addr")
+			}
+			versions = append(versions, o.Version)
+		}
+		for _, v := range versions {
+			if v != 0 && v != 1 && v != 2 {
+				return fmt.Errorf("configuration error: proxy protocol version %d is unknown", v)
+			}
+		}
+
+		if c.ProxyHeader.UserTLV != 0 && (c.ProxyHeader.UserTLV < int(proxyproto.PP2_TYPE_MIN_CUSTOM) || c.ProxyHeader.UserTLV > int(proxyproto.PP2_TYPE_MAX_CUSTOM)) {
+			return fmt.Errorf("configuration error: proxy protocol user_tlv must be custom type 0xE0-0xEF")
+		}
+	}
+
+	// validate access lists
+	if c.Access != nil {
+		users := make(map[string]bool)
+		for _, u := range c.Access.Users {
+			if len(u.Name) == 0 {
+				return fmt.Errorf("configuration error: access.user needs name")
+			}
+			if users[u.Name] {
+				return fmt.Errorf("configuration error: access.user %s is duplicated", u.Name)
+			}
+			users[u.Name] = true
+		}
+
+		if _, err := newAccessLists(c.Access); err != nil {
+			return fmt.Errorf("configuration error: access list is wrong: %v", err)
+		}
+	}
+
+	// validate origin TLS config
+	if c.OriginTLS != nil {
+		if err := validatePins(c.OriginTLS.Pins); err != nil {
+			return err
+		}
+		if err := validateOriginClientCert(c.OriginTLS); err != nil {
+			return err
+		}
+
+		if len(c.OriginTLS.Origins) > 0 {
+			logrus.Warn("[[origin_tls.origin]] is deprecated. use [origin.tls] of [[origin]] which takes precedence over it")
+		}
+
+		originAddrs := make(map[string]bool)
+		for _, o := range c.OriginTLS.Origins {
+			if len(o.Addr) == 0 {
+				return fmt.Errorf("configuration error: origin_tls.origin needs addr")
+			}
+			if originAddrs[o.Addr] {
+				return fmt.Errorf("configuration error: origin_tls.origin addr %s is duplicated", o.Addr)
+			}
+			originAddrs[o.Addr] = true
+
+			if err := validatePins(o.Pins); err != nil {
+				return err
+			}
+			if err := validateOriginClientCert(o); err != nil {
+				return err
+			}
+		}
+	}
+
+	// validate each origin config
+	if err := validateOrigins(c.Origins); err != nil {
+		return err
+	}
+
+	// validate origin pools
+	if err := validatePools(c.Pools); err != nil {
+		return err
+	}
+
+	// validate each listener config
+	listenAddrs := make(map[string]bool)
+	for _, l := range c.Listeners {
+		if len(l.ListenAddr) == 0 {
+			return fmt.Errorf("configuration error: listener needs listen_addr")
+		}
+		if listenAddrs[l.ListenAddr] {
+			return fmt.Errorf("configuration error: listen_addr %s is duplicated", l.ListenAddr)
+		}
+		listenAddrs[l.ListenAddr] = true
+
+		if (len(l.MasqueradeIP) > 0) && (net.ParseIP(l.MasqueradeIP)) == nil {
+			return fmt.Errorf("configuration error: Masquerade IP of listener %s is wrong", l.ListenAddr)
+		}
+
+		if err := validateTLSPair(l.TLS); err != nil {
+			return err
+		}
+
+		if l.ImplicitTLS && c.forListener(l).TLS == nil {
+			return fmt.Errorf("configuration error: implicit TLS listener %s needs tls config", l.ListenAddr)
+		}
+
+		if lc := c.forListener(l); lc.RequireTLS && lc.TLS == nil {
+			return fmt.Errorf("configuration error: require_tls listener %s needs tls config", l.ListenAddr)
+		}
+	}
+
+	return nil
+}
+
+// normalize transfer mode to PORT, PASV, EPSV or CLIENT
+func normalizeTransferMode(mode string) (string, error) {
+	mode = strings.ToUpper(mode)
+	switch mode {
 	case "PORT", "ACTIVE":
-		c.TransferMode = "PORT"
+		return "PORT", nil
 	case "PASV", "PASSIVE":
-		c.TransferMode = "PASV"
-	case "EPSV":
-		c.TransferMode = "EPSV"
-	case "CLIENT":
-		break
+		return "PASV", nil
+	case "EPSV", "CLIENT":
+		return mode, nil
 	default:
-		return fmt.Errorf("configuration error: Transfer mode config is wrong")
+		return "", fmt.Errorf("configuration error: Transfer mode config is wrong")
+	}
+}
+
+func validateOrigins(origins []*originConfig) error {
+	keys := make(map[string]bool)
+	for _, o := range origins {
+		if len(o.Addr) == 0 {
+			return fmt.Errorf("configuration error: origin needs addr")
+		}
+
+		for _, key := range []string{o.Addr, o.Name} {
+			if len(key) == 0 {
+				continue
+			}
+			if keys[key] {
+				return fmt.Errorf("configuration error: origin %s is duplicated", key)
+			}
+			keys[key] = true
+		}
+
+		if len(o.TransferMode) > 0 {
+			mode, err := normalizeTransferMode(o.TransferMode)
+			if err != nil {
+				return fmt.Errorf("configuration error: Transfer mode config of origin %s is wrong", o.Addr)
+			}
+			o.TransferMode = mode
+		}
+
+		if len(o.PassiveIP) > 0 && net.ParseIP(o.PassiveIP) == nil {
+			return fmt.Errorf("configuration error: passive IP of origin %s is wrong", o.Addr)
+		}
+
+		if o.ProxyProtocol != nil && (*o.ProxyProtocol < 0 || *o.ProxyProtocol > 2) {
+			return fmt.Errorf("configuration error: proxy protocol version %d of origin %s is unknown", *o.ProxyProtocol, o.Addr)
+		}
+
+		if o.ProxyTimeout < 0 || o.TransferTimeout < 0 || o.MaxConnections < 0 {
+			return fmt.Errorf("configuration error: timeouts and max connections of origin %s must not be negative", o.Addr)
+		}
+
+		if o.TLS != nil {
+			if err := validatePins(o.TLS.Pins); err != nil {
+				return err
+			}
+			if err := validateOriginClientCert(o.TLS); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validatePools(pools []*poolConfig) error {
+	names := make(map[string]bool)
+	for _, p := range pools {
+		if len(p.Name) == 0 {
+			return fmt.Errorf("configuration error: pool needs name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("configuration error: pool %s is duplicated", p.Name)
+		}
+		names[p.Name] = true
+
+		if len(p.Members) == 0 {
+			return fmt.Errorf("configuration error: pool %s needs members", p.Name)
+		}
+
+		if p.HealthCheckInterval < 0 || p.HealthCheckTimeout < 0 || p.HealthyThreshold < 0 ||
+			p.UnhealthyThreshold < 0 || p.MaxDialFailures < 0 || p.EjectionTime < 0 {
+			return fmt.Errorf("configuration error: settings of pool %s must not be negative", p.Name)
+		}
+		if p.HealthCheckTimeout == 0 {
+			p.HealthCheckTimeout = defaultHealthCheckTimeout
+		}
+		if p.HealthyThreshold == 0 {
+			p.HealthyThreshold = defaultHealthyThreshold
+		}
+		if p.UnhealthyThreshold == 0 {
+			p.UnhealthyThreshold = defaultUnhealthyThreshold
+		}
+		if p.MaxDialFailures == 0 {
+			p.MaxDialFailures = defaultMaxDialFailures
+		}
+		if p.EjectionTime == 0 {
+			p.EjectionTime = defaultEjectionTime
+		}
+
+		p.Strategy = strings.ToLower(p.Strategy)
+		if len(p.Strategy) == 0 {
+			p.Strategy = poolStrategyFailover
+		}
+		if !isPoolStrategy(p.Strategy) {
+			return fmt.Errorf("configuration error: strategy %s of pool %s is unknown", p.Strategy, p.Name)
+		}
+
+		if len(p.Weights) > 0 {
+			if len(p.Weights) != len(p.Members) {
+				return fmt.Errorf("configuration error: weights of pool %s must be set for each member", p.Name)
+			}
+			for _, w := range p.Weights {
+				if w <= 0 {
+					return fmt.Errorf("configuration error: weights of pool %s must be positive", p.Name)
+				}
+			}
+		}
+
+		p.HealthCheckProbe = strings.ToLower(p.HealthCheckProbe)
+		switch p.HealthCheckProbe {
+		case "":
+			p.HealthCheckProbe = poolProbeBanner
+		case poolProbeBanner, poolProbeNoop:
+		case poolProbeLogin:
+			if len(p.HealthCheckUser) == 0 {
+				return fmt.Errorf("configuration error: login probe of pool %s needs health_check_user", p.Name)
+			}
+		default:
+			return fmt.Errorf("configuration error: health check probe %s of pool %s is unknown", p.HealthCheckProbe, p.Name)
+		}
+	}
+
+	return nil
+}
+
+// pins are base64 encoded SHA-256 hash of SubjectPublicKeyInfo
+func validatePins(pins []string) error {
+	for _, pin := range pins {
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("configuration error: pin %s is not base64 encoded SHA-256 hash", pin)
+		}
+	}
+
+	return nil
+}
+
+// client cert and key for origin must be set together
+func validateOriginClientCert(o *originTLSConfig) error {
+	if (len(o.ClientCert) > 0) != (len(o.ClientKey) > 0) {
+		return fmt.Errorf("configuration error: origin_tls needs both client_cert and client_key")
 	}
 
 	return nil
 }
 
 type tlsPair struct {
-	Cert        string `toml:"cert"`
-	Key         string `toml:"key"`
-	CACert      string `toml:"ca_cert"`
-	CipherSuite string `toml:"cipher_suite"`
-	MinProtocol string `toml:"min_protocol"`
-	MaxProtocol string `toml:"max_protocol"`
+	Cert        string     `toml:"cert"`
+	Key         string     `toml:"key"`
+	CACert      string     `toml:"ca_cert"`
+	CipherSuite string     `toml:"cipher_suite"`
+	MinProtocol string     `toml:"min_protocol"`
+	MaxProtocol string     `toml:"max_protocol"`
+	SNI         []*sniCert `toml:"sni"`
+
+	// client certificate authentication
+	ClientAuth     string `toml:"client_auth"`
+	ClientCertUser string `toml:"client_cert_user"`
+
+	// reject client data connections which do not resume control session
+	RequireSessionReuse bool `toml:"require_session_reuse"`
+}
+
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequired = "required"
+
+	clientCertUserCN    = "cn"
+	clientCertUserEmail = "email"
+	clientCertUserDNS   = "dns"
+)
+
+// sniCert is a certificate selected by server name of TLS ClientHello.
+// hosts can contain wildcard like *.example.com
+type sniCert struct {
+	Hosts []string `toml:"hosts"`
+	Cert  string   `toml:"cert"`
+	Key   string   `toml:"key"`
+}
+
+// validate SNI certificate and client certificate settings
+func validateTLSPair(t *tlsPair) error {
+	if t == nil {
+		return nil
+	}
+
+	t.ClientAuth = strings.ToLower(t.ClientAuth)
+	switch t.ClientAuth {
+	case "":
+		t.ClientAuth = clientAuthNone
+	case clientAuthNone, clientAuthOptional, clientAuthRequired:
+	default:
+		return fmt.Errorf("configuration error: client_auth %s is unknown", t.ClientAuth)
+	}
+
+	t.ClientCertUser = strings.ToLower(t.ClientCertUser)
+	switch t.ClientCertUser {
+	case "":
+		t.ClientCertUser = clientCertUserCN
+	case clientCertUserCN, clientCertUserEmail, clientCertUserDNS:
+	default:
+		return fmt.Errorf("configuration error: client_cert_user %s is unknown", t.ClientCertUser)
+	}
+
+	for _, sni := range t.SNI {
+		if len(sni.Hosts) == 0 {
+			return fmt.Errorf("configuration error: sni certificate needs hosts")
+		}
+		if len(sni.Cert) == 0 || len(sni.Key) == 0 {
+			return fmt.Errorf("configuration error: sni certificate for %s needs cert and key", strings.Join(sni.Hosts, ","))
+		}
+	}
+
+	return nil
 }
 
 // NewTLSConfig creates a new tlsPair instance and applies the provided options.
@@ -131,6 +916,11 @@ func defaultConfig(config *config) {
 	config.WelcomeMsg = "FTP proxy ready"
 	config.TransferMode = "CLIENT"
 	config.IgnorePassiveIP = false
+	config.ImplicitTLS = false
+	config.OriginImplicit = false
+	config.RequireTLS = false
+	config.ForceOriginTLS = false
+	config.ShutdownTimeout = 60
 }
 
 func dataPortRangeValidation(r string) error {
@@ -206,6 +996,41 @@ func WithMaxConnections(maxConn int32) ConfigOption {
 	}
 }
 
+// WithMaxConnectionsPerIP sets the maximum number of simultaneous connections from one client IP address.
+func WithMaxConnectionsPerIP(maxConn int32) ConfigOption {
+	return func(c *config) {
+		c.MaxConnsPerIP = maxConn
+	}
+}
+
+// WithMaxConnectionsPerUser sets the maximum number of simultaneous connections of one user.
+func WithMaxConnectionsPerUser(maxConn int32) ConfigOption {
+	return func(c *config) {
+		c.MaxConnsPerUser = maxConn
+	}
+}
+
+// WithMaxConnectionsPerOrigin sets the maximum number of simultaneous connections to one origin server.
+func WithMaxConnectionsPerOrigin(maxConn int32) ConfigOption {
+	return func(c *config) {
+		c.MaxConnsOrigin = maxConn
+	}
+}
+
+// WithTrustedProxies sets the CIDR list of load balancers which send PROXY protocol header.
+func WithTrustedProxies(trustedProxies []string) ConfigOption {
+	return func(c *config) {
+		c.TrustedProxies = trustedProxies
+	}
+}
+
+// WithProxyHeaderTimeout sets the timeout for reading PROXY protocol header in seconds.
+func WithProxyHeaderTimeout(timeout int) ConfigOption {
+	return func(c *config) {
+		c.ProxyHeaderTime = timeout
+	}
+}
+
 // WithProxyProtocol enables or disables the proxy protocol.
 func WithProxyProtocol(proxyProtocol bool) ConfigOption {
 	return func(c *config) {
@@ -262,6 +1087,111 @@ func WithIgnorePassiveIP(ignorePassiveIP bool) ConfigOption {
 	}
 }
 
+// WithImplicitTLS enables or disables implicit TLS between client and pftp.
+func WithImplicitTLS(implicitTLS bool) ConfigOption {
+	return func(c *config) {
+		c.ImplicitTLS = implicitTLS
+	}
+}
+
+// WithOriginImplicitTLS enables or disables implicit TLS between pftp and origin.
+func WithOriginImplicitTLS(originImplicit bool) ConfigOption {
+	return func(c *config) {
+		c.OriginImplicit = originImplicit
+	}
+}
+
+// WithRequireTLS sets whether AUTH TLS before USER and PROT P before transfer are required.
+func WithRequireTLS(requireTLS bool) ConfigOption {
+	return func(c *config) {
+		c.RequireTLS = requireTLS
+	}
+}
+
+// WithForceOriginTLS sets whether pftp uses TLS with origin even if client uses cleartext.
+func WithForceOriginTLS(forceOriginTLS bool) ConfigOption {
+	return func(c *config) {
+		c.ForceOriginTLS = forceOriginTLS
+	}
+}
+
+// WithListener adds a listener with its own settings to the server.
+func WithListener(l *listenerConfig) ConfigOption {
+	return func(c *config) {
+		c.Listeners = append(c.Listeners, l)
+	}
+}
+
+// WithResolver sets the origin resolver configuration for the server.
+func WithResolver(r *resolverConfig) ConfigOption {
+	return func(c *config) {
+		c.Resolver = r
+	}
+}
+
+// WithMetricsListenAddr sets the listening address of the metrics http server.
+func WithMetricsListenAddr(addr string) ConfigOption {
+	return func(c *config) {
+		c.MetricsAddr = addr
+	}
+}
+
+// WithAuditLog sets the per transfer audit log configuration for the server.
+func WithAuditLog(a *auditLogConfig) ConfigOption {
+	return func(c *config) {
+		c.AuditLog = a
+	}
+}
+
+// WithBruteForce sets the login failure protection configuration.
+func WithBruteForce(b *bruteForceConfig) ConfigOption {
+	return func(c *config) {
+		c.BruteForce = b
+	}
+}
+
+// WithProxyHeader sets the PROXY protocol header configuration sent to origin.
+func WithProxyHeader(p *proxyHeaderConfig) ConfigOption {
+	return func(c *config) {
+		c.ProxyHeader = p
+	}
+}
+
+// WithOrigins sets the settings of each origin.
+func WithOrigins(origins []*originConfig) ConfigOption {
+	return func(c *config) {
+		c.Origins = origins
+	}
+}
+
+// WithPools sets the origin pools with health checks.
+func WithPools(pools []*poolConfig) ConfigOption {
+	return func(c *config) {
+		c.Pools = pools
+	}
+}
+
+// WithAccess sets the CIDR lists of client IP addresses.
+func WithAccess(a *accessConfig) ConfigOption {
+	return func(c *config) {
+		c.Access = a
+	}
+}
+
+// WithOriginTLS sets the policy of verifying origin server certificates.
+func WithOriginTLS(o *originTLSConfig) ConfigOption {
+	return func(c *config) {
+		c.OriginTLS = o
+	}
+}
+
+// WithShutdownTimeout sets the deadline for draining sessions on shutdown in seconds.
+func WithShutdownTimeout(timeout int) ConfigOption {
+	return func(c *config) {
+		c.ShutdownTimeout = timeout
+	}
+}
+
 // WithTLSConfig sets the TLS configuration for the server.
 func WithTLSConfig(tls *tlsPair) ConfigOption {
 	return func(c *config) {
@@ -311,3 +1241,101 @@ func WithMaxProtocol(maxProtocol string) TLSConfigOption {
 		t.MaxProtocol = maxProtocol
 	}
 }
+
+// WithClientAuth sets client certificate authentication mode (none, optional or required).
+func WithClientAuth(clientAuth string) TLSConfigOption {
+	return func(t *tlsPair) {
+		t.ClientAuth = clientAuth
+	}
+}
+
+// WithClientCertUser sets the certificate field mapped to FTP user (cn, email or dns).
+func WithClientCertUser(field string) TLSConfigOption {
+	return func(t *tlsPair) {
+		t.ClientCertUser = field
+	}
+}
+
+// WithRequireSessionReuse sets whether client data connections must resume the TLS session of control connection.
+func WithRequireSessionReuse(requireSessionReuse bool) TLSConfigOption {
+	return func(t *tlsPair) {
+		t.RequireSessionReuse = requireSessionReuse
+	}
+}
+
+// WithSNICertificate adds a certificate selected by server name of TLS ClientHello.
+func WithSNICertificate(hosts []string, cert string, key string) TLSConfigOption {
+	return func(t *tlsPair) {
+		t.SNI = append(t.SNI, &sniCert{Hosts: hosts, Cert: cert, Key: key})
+	}
+}
+
+// NewListenerConfig creates a new listenerConfig instance and applies the provided options.
+// Returns the configured listener settings.
+func NewListenerConfig(opts ...ListenerConfigOption) listenerConfig {
+	l := listenerConfig{}
+
+	for _, o := range opts {
+		o(&l)
+	}
+
+	return l
+}
+
+type ListenerConfigOption func(l *listenerConfig)
+
+// WithListenerAddr sets the listening address for the listener.
+func WithListenerAddr(addr string) ListenerConfigOption {
+	return func(l *listenerConfig) {
+		l.ListenAddr = addr
+	}
+}
+
+// WithListenerWelcomeMessage sets the welcome message for the listener.
+func WithListenerWelcomeMessage(msg string) ListenerConfigOption {
+	return func(l *listenerConfig) {
+		l.WelcomeMsg = msg
+	}
+}
+
+// WithListenerMasqueradeIP sets the IP address for masquerading connections of the listener.
+func WithListenerMasqueradeIP(masqueradeIP string) ListenerConfigOption {
+	return func(l *listenerConfig) {
+		l.MasqueradeIP = masqueradeIP
+	}
+}
+
+// WithListenerMaxConnections sets the maximum number of simultaneous connections of the listener.
+func WithListenerMaxConnections(maxConn int32) ListenerConfigOption {
+	return func(l *listenerConfig) {
+		l.MaxConnections = maxConn
+	}
+}
+
+// WithListenerImplicitTLS enables or disables implicit TLS of the listener.
+func WithListenerImplicitTLS(implicitTLS bool) ListenerConfigOption {
+	return func(l *listenerConfig) {
+		l.ImplicitTLS = implicitTLS
+	}
+}
+
+// WithListenerRequireTLS sets whether the listener requires TLS before USER and transfer.
+func WithListenerRequireTLS(requireTLS bool) ListenerConfigOption {
+	return func(l *listenerConfig) {
+		l.RequireTLS = requireTLS
+	}
+}
+
+// WithListenerDisableTLS disables TLS of the listener even if global TLS configuration is set.
+func WithListenerDisableTLS(disableTLS bool) ListenerConfigOption {
+	return func(l *listenerConfig) {
+		l.DisableTLS = disableTLS
+	}
+}
+
+// WithListenerTLSConfig sets the TLS configuration for the listener.
+func WithListenerTLSConfig(tls *tlsPair) ListenerConfigOption {
+	return func(l *listenerConfig) {
+		l.TLS = tls
+	}
+}
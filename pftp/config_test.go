@@ -0,0 +1,403 @@
+package pftp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_config_listenerConfigs(t *testing.T) {
+	globalTLS := &tlsPair{
+		Cert: "../tls/server.crt",
+		Key:  "../tls/server.key",
+	}
+	listenerTLS := &tlsPair{
+		Cert: "./listener.crt",
+		Key:  "./listener.key",
+	}
+
+	type want struct {
+		listenAddr     string
+		welcomeMsg     string
+		masqueradeIP   string
+		maxConnections int32
+		implicitTLS    bool
+		tls            *tlsPair
+	}
+
+	tests := []struct {
+		name   string
+		config *config
+		want   []want
+	}{
+		{
+			name: "no_listener",
+			config: &config{
+				ListenAddr:     "127.0.0.1:2121",
+				WelcomeMsg:     "global",
+				MaxConnections: 10,
+				TLS:            globalTLS,
+			},
+			want: []want{
+				{
+					listenAddr:     "127.0.0.1:2121",
+					welcomeMsg:     "global",
+					maxConnections: 10,
+					tls:            globalTLS,
+				},
+			},
+		},
+		{
+			name: "inherit_and_override",
+			config: &config{
+				ListenAddr:     "127.0.0.1:2121",
+				WelcomeMsg:     "global",
+				MasqueradeIP:   "10.0.0.1",
+				MaxConnections: 10,
+				TLS:            globalTLS,
+				Listeners: []*listenerConfig{
+					{
+						ListenAddr: "127.0.0.1:21",
+						DisableTLS: true,
+					},
+					{
+						ListenAddr:     "127.0.0.1:2121",
+						WelcomeMsg:     "explicit",
+						MaxConnections: 20,
+					},
+					{
+						ListenAddr:   "127.0.0.1:990",
+						MasqueradeIP: "10.0.0.2",
+						ImplicitTLS:  true,
+						TLS:          listenerTLS,
+					},
+				},
+			},
+			want: []want{
+				{
+					listenAddr:     "127.0.0.1:21",
+					welcomeMsg:     "global",
+					masqueradeIP:   "10.0.0.1",
+					maxConnections: 10,
+				},
+				{
+					listenAddr:     "127.0.0.1:2121",
+					welcomeMsg:     "explicit",
+					masqueradeIP:   "10.0.0.1",
+					maxConnections: 20,
+					tls:            globalTLS,
+				},
+				{
+					listenAddr:     "127.0.0.1:990",
+					welcomeMsg:     "global",
+					masqueradeIP:   "10.0.0.2",
+					maxConnections: 10,
+					implicitTLS:    true,
+					tls:            listenerTLS,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []want
+			for _, c := range tt.config.listenerConfigs() {
+				got = append(got, want{
+					listenAddr:     c.ListenAddr,
+					welcomeMsg:     c.WelcomeMsg,
+					masqueradeIP:   c.MasqueradeIP,
+					maxConnections: c.MaxConnections,
+					implicitTLS:    c.ImplicitTLS,
+					tls:            c.TLS,
+				})
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("config.listenerConfigs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateConfig_listeners(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *config
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			config: &config{
+				TransferMode: "CLIENT",
+				TLS:          &tlsPair{},
+				Listeners: []*listenerConfig{
+					{ListenAddr: "127.0.0.1:21"},
+					{ListenAddr: "127.0.0.1:990", ImplicitTLS: true},
+				},
+			},
+		},
+		{
+			name: "duplicated_listen_addr",
+			config: &config{
+				TransferMode: "CLIENT",
+				Listeners: []*listenerConfig{
+					{ListenAddr: "127.0.0.1:21"},
+					{ListenAddr: "127.0.0.1:21"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "implicit_tls_without_tls",
+			config: &config{
+				TransferMode: "CLIENT",
+				TLS:          &tlsPair{},
+				Listeners: []*listenerConfig{
+					{ListenAddr: "127.0.0.1:990", ImplicitTLS: true, DisableTLS: true},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong_masquerade_ip",
+			config: &config{
+				TransferMode: "CLIENT",
+				Listeners: []*listenerConfig{
+					{ListenAddr: "127.0.0.1:21", MasqueradeIP: "999.0.0.1"},
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateConfig(tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_config_forOrigin(t *testing.T) {
+	proxyV2 := 2
+	proxyOff := 0
+	ignore := true
+
+	c := &config{
+		ProxyProtocol:   true,
+		TransferMode:    "CLIENT",
+		ProxyTimeout:    900,
+		TransferTimeout: 900,
+		MaxConnsOrigin:  10,
+		// deprecated table is used only when [[origin]] does not set version
+		ProxyHeader: &proxyHeaderConfig{
+			Origins: []*proxyHeaderOrigin{
+				{Addr: "192.168.10.1:21", Version: 1},
+				{Addr: "127.0.0.1:21", Version: 2},
+			},
+		},
+		Origins: []*originConfig{
+			{
+				Name:            "nat",
+				Addr:            "192.168.10.1:21",
+				ProxyProtocol:   &proxyV2,
+				TransferMode:    "PASV",
+				IgnorePassiveIP: &ignore,
+				PassiveIP:       "203.0.113.1",
+				ProxyTimeout:    60,
+				MaxConnections:  5,
+			},
+			{
+				Addr:          "192.168.10.2:21",
+				ProxyProtocol: &proxyOff,
+			},
+		},
+	}
+
+	type want struct {
+		addr             string
+		proxyProtocol    bool
+		proxyVersion     int
+		ignoreProxyError bool
+		transferMode     string
+		ignorePassiveIP  bool
+		passiveIP        string
+		proxyTimeout     int
+		transferTimeout  int
+		maxConnsOrigin   int32
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   want
+	}{
+		{
+			name:   "by_name",
+			target: "nat",
+			want: want{
+				addr:            "192.168.10.1:21",
+				proxyProtocol:   true,
+				proxyVersion:    2,
+				transferMode:    "PASV",
+				ignorePassiveIP: true,
+				passiveIP:       "203.0.113.1",
+				proxyTimeout:    60,
+				transferTimeout: 900,
+				maxConnsOrigin:  5,
+			},
+		},
+		{
+			name:   "by_addr_without_proxy_protocol",
+			target: "192.168.10.2:21",
+			want: want{
+				addr:            "192.168.10.2:21",
+				proxyVersion:    1,
+				transferMode:    "CLIENT",
+				proxyTimeout:    900,
+				transferTimeout: 900,
+				maxConnsOrigin:  10,
+			},
+		},
+		{
+			name:   "not_configured",
+			target: "127.0.0.1:21",
+			want: want{
+				addr:             "127.0.0.1:21",
+				proxyProtocol:    true,
+				proxyVersion:     2,
+				ignoreProxyError: true,
+				transferMode:     "CLIENT",
+				proxyTimeout:     900,
+				transferTimeout:  900,
+				maxConnsOrigin:   10,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oc, addr := c.forOrigin(tt.target)
+			got := want{
+				addr:             addr,
+				proxyProtocol:    oc.ProxyProtocol,
+				proxyVersion:     oc.proxyProtocolVersion(addr),
+				ignoreProxyError: oc.ignoreProxyError(),
+				transferMode:     oc.TransferMode,
+				ignorePassiveIP:  oc.IgnorePassiveIP,
+				passiveIP:        oc.passiveIP,
+				proxyTimeout:     oc.ProxyTimeout,
+				transferTimeout:  oc.TransferTimeout,
+				maxConnsOrigin:   oc.MaxConnsOrigin,
+			}
+
+			if got != tt.want {
+				t.Errorf("config.forOrigin() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateConfig_origins(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []*originConfig
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			origins: []*originConfig{
+				{Name: "main", Addr: "127.0.0.1:21", TransferMode: "passive"},
+				{Addr: "127.0.0.1:2121", PassiveIP: "203.0.113.1"},
+			},
+		},
+		{
+			name:    "no_addr",
+			origins: []*originConfig{{Name: "main"}},
+			wantErr: true,
+		},
+		{
+			name: "duplicated_name",
+			origins: []*originConfig{
+				{Name: "main", Addr: "127.0.0.1:21"},
+				{Name: "main", Addr: "127.0.0.1:2121"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "wrong_transfer_mode",
+			origins: []*originConfig{{Addr: "127.0.0.1:21", TransferMode: "unknown"}},
+			wantErr: true,
+		},
+		{
+			name:    "wrong_passive_ip",
+			origins: []*originConfig{{Addr: "127.0.0.1:21", PassiveIP: "999.0.0.1"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config{TransferMode: "CLIENT", Origins: tt.origins}
+			if err := validateConfig(c); (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateConfig_pools(t *testing.T) {
+	tests := []struct {
+		name    string
+		pools   []*poolConfig
+		wantErr bool
+	}{
+		{
+			name:  "ok",
+			pools: []*poolConfig{{Name: "backend", Members: []string{"127.0.0.1:21", "127.0.0.1:2121"}, Strategy: "Weighted", Weights: []int{2, 1}, HealthCheckProbe: "NOOP"}},
+		},
+		{
+			name:    "no_members",
+			pools:   []*poolConfig{{Name: "backend"}},
+			wantErr: true,
+		},
+		{
+			name: "duplicated_name",
+			pools: []*poolConfig{
+				{Name: "backend", Members: []string{"127.0.0.1:21"}},
+				{Name: "backend", Members: []string{"127.0.0.1:2121"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown_probe",
+			pools:   []*poolConfig{{Name: "backend", Members: []string{"127.0.0.1:21"}, HealthCheckProbe: "stat"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown_strategy",
+			pools:   []*poolConfig{{Name: "backend", Members: []string{"127.0.0.1:21"}, Strategy: "random"}},
+			wantErr: true,
+		},
+		{
+			name:    "weights_not_match_members",
+			pools:   []*poolConfig{{Name: "backend", Members: []string{"127.0.0.1:21", "127.0.0.1:2121"}, Strategy: "weighted", Weights: []int{1}}},
+			wantErr: true,
+		},
+		{
+			name:    "login_probe_without_user",
+			pools:   []*poolConfig{{Name: "backend", Members: []string{"127.0.0.1:21"}, HealthCheckProbe: "login"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config{TransferMode: "CLIENT", Pools: tt.pools}
+			if err := validateConfig(c); (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,11 +1,18 @@
 package pftp
 
-import "net"
+import (
+	"crypto/x509"
+	"net"
+)
 
 // Context struct got remote server address
 type Context struct {
 	RemoteAddr string
 	ClientAddr string
+	// ServerName is the SNI sent by client on TLS handshake
+	ServerName string
+	// ClientCertificate is the verified certificate of client
+	ClientCertificate *x509.Certificate
 }
 
 func newContext(c *config, conn net.Conn) *Context {
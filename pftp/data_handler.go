@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tevino/abool"
@@ -32,6 +33,10 @@ type dataHandler struct {
 	inDataTransfer     *abool.AtomicBool
 	closed             bool
 	mutex              *sync.Mutex
+	uploadBytes        int64
+	downloadBytes      int64
+	auditLog           *auditLogger
+	transfer           *transferRecord
 }
 
 type connector struct {
@@ -270,8 +275,12 @@ func (d *dataHandler) isStarted() bool {
 // Make listener for data connection
 func (d *dataHandler) StartDataTransfer(direction string) error {
 	var err error
+	var duration time.Duration
 
 	defer connectionCloser(d, d.log)
+	defer func() {
+		d.writeAuditLog(direction, duration, err)
+	}()
 
 	eg := errgroup.Group{}
 
@@ -295,7 +304,7 @@ func (d *dataHandler) StartDataTransfer(direction string) error {
 	})
 
 	// wait until copy goroutine end
-	if err := eg.Wait(); err != nil {
+	if err = eg.Wait(); err != nil {
 		if strings.Contains(err.Error(), "EOF") {
 			d.log.debug("data connection aborted by EOF")
 		} else {
@@ -311,13 +320,19 @@ func (d *dataHandler) StartDataTransfer(direction string) error {
 	d.clientConn.communicationConn.SetDeadline(time.Time{})
 	d.originConn.communicationConn.SetDeadline(time.Time{})
 
-	if err := d.run(); err != nil {
+	start := time.Now()
+	if err = d.run(); err != nil {
 		if !strings.Contains(err.Error(), alreadyClosedMsg) {
 			d.log.err("got error on %s data transfer: %s", direction, err.Error())
 		}
 	} else {
 		d.log.debug("%s data transfer finished", direction)
 	}
+	duration = time.Since(start)
+
+	metrics.transferBytes.add(uploadStream, uint64(atomic.LoadInt64(&d.uploadBytes)))
+	metrics.transferBytes.add(downloadStream, uint64(atomic.LoadInt64(&d.downloadBytes)))
+	metrics.transferDurations.observe(direction, duration.Seconds())
 
 	// set timeout to each connection
 	d.clientConn.communicationConn.SetDeadline(time.Now().Add(time.Duration(d.config.IdleTimeout) * time.Second))
@@ -326,6 +341,30 @@ func (d *dataHandler) StartDataTransfer(direction string) error {
 	return err
 }
 
+// write transfer record to audit log
+func (d *dataHandler) writeAuditLog(direction string, duration time.Duration, err error) {
+	if d.auditLog == nil || d.transfer == nil {
+		return
+	}
+
+	d.transfer.Direction = direction
+	d.transfer.Duration = duration.Seconds()
+	d.transfer.Status = "complete"
+	if err != nil {
+		d.transfer.Status = "incomplete"
+	}
+
+	if direction == uploadStream {
+		d.transfer.Bytes = atomic.LoadInt64(&d.uploadBytes)
+	} else {
+		d.transfer.Bytes = atomic.LoadInt64(&d.downloadBytes)
+	}
+
+	if err := d.auditLog.write(d.transfer); err != nil {
+		d.log.err("cannot write audit log: %s", err.Error())
+	}
+}
+
 // make client connection
 func (d *dataHandler) clientListenOrDial(clientConnected chan error) error {
 	// if client connect needs listen, open listener
@@ -397,7 +436,7 @@ func (d *dataHandler) clientListenOrDial(clientConnected chan error) error {
 	}
 
 	if d.needTLSForTransfer.IsSet() {
-		if d.tlsDataSet.forClient.getTLSConfig() == nil {
+		if d.tlsDataSet.forClient.getDataTLSConfig() == nil {
 			return errors.New("cannot get client TLS config for data transfer. abort data transfer")
 		}
 
@@ -409,12 +448,19 @@ func (d *dataHandler) clientListenOrDial(clientConnected chan error) error {
 		dataConn := d.clientConn.dataConn
 		d.mutex.Unlock()
 
-		tlsConn := tls.Server(dataConn, d.tlsDataSet.forClient.getTLSConfig())
+		tlsConn := tls.Server(dataConn, d.tlsDataSet.forClient.getDataTLSConfig())
 		if err := tlsConn.Handshake(); err != nil {
+			metrics.tlsHandshakeFails.inc("client")
 			return fmt.Errorf("TLS client data connection handshake got error: %v", err)
 		}
 		d.log.debug("TLS data connection with client has set. TLS protocol version: %s and Cipher Suite: %s. (resumed?: %v)", getTLSProtocolName(tlsConn.ConnectionState().Version), tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite), tlsConn.ConnectionState().DidResume)
 
+		// like vsftpd require_ssl_reuse, data connection must resume control session
+		if d.tlsDataSet.forClient.requireSessionReuse && !tlsConn.ConnectionState().DidResume {
+			tlsConn.Close()
+			return errors.New("TLS client data connection did not resume the session of control connection")
+		}
+
 		d.clientConn.dataConn = tlsConn
 	}
 
@@ -496,8 +542,8 @@ func (d *dataHandler) originListenOrDial(clientConnected chan error) error {
 		d.originConn.dataConn = tcpConn
 	}
 
-	// set TLS session.
-	if d.needTLSForTransfer.IsSet() {
+	// set TLS session. origin uses TLS regardless of client when force origin TLS
+	if d.needTLSForTransfer.IsSet() || d.config.ForceOriginTLS {
 		if d.tlsDataSet.forOrigin.getTLSConfig() == nil {
 			return errors.New("cannot get origin TLS config for data transfer. abort data transfer")
 		}
@@ -512,6 +558,7 @@ func (d *dataHandler) originListenOrDial(clientConnected chan error) error {
 
 		tlsConn := tls.Client(dataConn, d.tlsDataSet.forOrigin.getTLSConfig())
 		if err := tlsConn.Handshake(); err != nil {
+			metrics.tlsHandshakeFails.inc("origin")
 			return fmt.Errorf("TLS origin data connection handshake got error: %v", err)
 		}
 		d.log.debug("TLS data connection with origin has set. TLS protocol version: %s and Cipher Suite: %s. (resumed?: %v)", getTLSProtocolName(tlsConn.ConnectionState().Version), tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite), tlsConn.ConnectionState().DidResume)
@@ -535,11 +582,11 @@ func (d *dataHandler) run() error {
 
 	// origin to client
 	eg.Go(func() error {
-		return d.copyPackets(d.clientConn.dataConn, d.originConn.dataConn, d.config.TransferTimeout)
+		return d.copyPackets(d.clientConn.dataConn, d.originConn.dataConn, d.config.TransferTimeout, &d.downloadBytes)
 	})
 	// client to origin
 	eg.Go(func() error {
-		return d.copyPackets(d.originConn.dataConn, d.clientConn.dataConn, d.config.TransferTimeout)
+		return d.copyPackets(d.originConn.dataConn, d.clientConn.dataConn, d.config.TransferTimeout, &d.uploadBytes)
 	})
 
 	// wait until copy goroutine end
@@ -551,21 +598,26 @@ func (d *dataHandler) run() error {
 // send src packet to dst.
 // replace io.Copy function to manual coding because io.Copy
 // function can not increase src conn's deadline per each read.
-func (d *dataHandler) copyPackets(dst net.Conn, src net.Conn, timeout int) error {
+// written bytes are added to transferred.
+func (d *dataHandler) copyPackets(dst net.Conn, src net.Conn, timeout int, transferred *int64) error {
 	lastErr := error(nil)
 	buff := make([]byte, bufferSize)
 
 	for {
 		// check about aborted from outside of handler
 		if d.isClosed() {
+			lastErr = errors.New("abort: data handler already closed")
 			break
 		}
 
 		n, err := src.Read(buff)
 		if n > 0 {
 			// stop coping when failed to write dst socket
-			if _, err := dst.Write(buff[:n]); err != nil {
+			written, err := dst.Write(buff[:n])
+			atomic.AddInt64(transferred, int64(written))
+			if err != nil {
 				dst.Close()
+				lastErr = err
 				break
 			}
 			// increase data transfer timeout
@@ -632,8 +684,11 @@ func (d *dataHandler) parsePASVresponse(line string) error {
 
 	d.originConn.remoteIP, d.originConn.remotePort, err = parseLineToAddr(line[startIndex+1 : endIndex])
 
-	// if received ip is not public IP, ignore it
-	if !isPublicIP(net.ParseIP(d.originConn.remoteIP)) || d.config.IgnorePassiveIP {
+	// if received ip is not public IP, ignore it.
+	// origin behind NAT has own passive IP
+	if len(d.config.passiveIP) > 0 {
+		d.originConn.remoteIP = d.config.passiveIP
+	} else if !isPublicIP(net.ParseIP(d.originConn.remoteIP)) || d.config.IgnorePassiveIP {
 		d.originConn.remoteIP = d.originConn.originalRemoteIP
 	}
 
@@ -657,6 +712,8 @@ func (d *dataHandler) parseEPSVresponse(line string) error {
 		return fmt.Errorf("invalid data address")
 	}
 
+	// EPSV response does not contain IP address. use origin control connection's IP
+	d.originConn.remoteIP = d.originConn.originalRemoteIP
 	d.originConn.remotePort = originPort
 
 	return nil
@@ -725,6 +782,13 @@ func parseEPRTtoAddr(line string) (string, string, error) {
 	return IP, port, nil
 }
 
+// check IP is IPv6. IPv4-mapped IPv6 address is treated as IPv4
+func isIPv6(IP string) bool {
+	ip := net.ParseIP(IP)
+
+	return ip != nil && ip.To4() == nil
+}
+
 // check IP is public
 // ** private IP range **
 // Class       Starting IPAddress     Ending IP Address    # Host counts
@@ -1,7 +1,15 @@
 package pftp
 
 import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/tevino/abool"
@@ -391,10 +399,13 @@ func Test_dataHandler_parsePASVresponse(t *testing.T) {
 }
 
 func Test_dataHandler_parseEPSV(t *testing.T) {
+	_, originConn := acceptTestConn(t)
+
 	type fields struct {
-		line   string
-		mode   string
-		config *config
+		line       string
+		mode       string
+		config     *config
+		originConn net.Conn
 	}
 
 	type want struct {
@@ -437,6 +448,22 @@ func Test_dataHandler_parseEPSV(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			// EPSV response has no IP address, so use origin control connection's IP
+			name: "epsv_mode_origin_ip",
+			fields: fields{
+				line:       "229 Entering Extended Passive Mode (|||25610|)\r\n",
+				mode:       "EPSV",
+				config:     &config{},
+				originConn: originConn,
+			},
+			want: want{
+				ip:   "127.0.0.1",
+				port: "25610",
+				err:  "",
+			},
+			wantErr: false,
+		},
 		{
 			name: "epsve_mode_parse_ok",
 			fields: fields{
@@ -463,7 +490,7 @@ func Test_dataHandler_parseEPSV(t *testing.T) {
 				tt.fields.config,
 				nil,
 				nil,
-				nil,
+				tt.fields.originConn,
 				tt.fields.mode,
 				nil,
 				transferInTLS,
@@ -488,3 +515,247 @@ func Test_dataHandler_parseEPSV(t *testing.T) {
 		})
 	}
 }
+
+func Test_isIPv6(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{
+			name: "ipv4",
+			ip:   "192.168.10.1",
+			want: false,
+		},
+		{
+			name: "ipv4_mapped_ipv6",
+			ip:   "::ffff:192.168.10.1",
+			want: false,
+		},
+		{
+			name: "ipv6",
+			ip:   "2001:db8::1",
+			want: true,
+		},
+		{
+			name: "invalid",
+			ip:   "2001:db8::zz",
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIPv6(tt.ip); got != tt.want {
+				t.Errorf("isIPv6() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_clientHandler_handleDATA(t *testing.T) {
+	type fields struct {
+		command string
+		line    string
+		config  *config
+		network string
+		address string
+	}
+
+	type res struct {
+		code int
+		msg  string
+	}
+
+	tests := []struct {
+		name       string
+		fields     fields
+		want       res
+		wantOrigin string
+	}{
+		{
+			name: "pasv_ipv6_masquerade",
+			fields: fields{
+				command: "PASV",
+				line:    "PASV\r\n",
+				config:  &config{DataChanProxy: true, MasqueradeIP: "2001:db8::1"},
+			},
+			want: res{
+				code: 425,
+				msg:  "Can't open passive connection on IPv6 address, use EPSV",
+			},
+		},
+		{
+			name: "port_ipv4_origin",
+			fields: fields{
+				command: "PORT",
+				line:    "PORT 203,0,113,1,4,1\r\n",
+				config:  &config{DataChanProxy: true, TransferMode: "CLIENT"},
+				network: "tcp4",
+				address: "127.0.0.1:0",
+			},
+			wantOrigin: "PORT 127,0,0,1,",
+		},
+		{
+			// PORT command can not contain IPv6 address
+			name: "eprt_ipv6_origin",
+			fields: fields{
+				command: "EPRT",
+				line:    "EPRT |2|2001:db8::2|1025|\r\n",
+				config:  &config{DataChanProxy: true, TransferMode: "CLIENT"},
+				network: "tcp6",
+				address: "[::1]:0",
+			},
+			wantOrigin: "EPRT |2|::1|",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, _ := acceptTestConn(t)
+
+			c := &clientHandler{
+				config:         tt.fields.config,
+				conn:           clientConn,
+				command:        tt.fields.command,
+				line:           tt.fields.line,
+				log:            &logger{},
+				transferInTLS:  abool.New(),
+				inDataTransfer: abool.New(),
+				proxy: &proxyServer{
+					isLoggedin: true,
+					log:        &logger{},
+				},
+			}
+
+			var originReader *bufio.Reader
+			if tt.fields.network != "" {
+				l, err := net.Listen(tt.fields.network, tt.fields.address)
+				if err != nil {
+					t.Skipf("%s is not available: %v", tt.fields.network, err)
+				}
+				defer l.Close()
+
+				conn, err := net.Dial(tt.fields.network, l.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				origin, err := l.Accept()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer origin.Close()
+
+				c.proxy.origin = conn
+				c.proxy.originWriter = bufio.NewWriter(conn)
+				originReader = bufio.NewReader(origin)
+			}
+			defer c.proxy.Close()
+
+			got := res{}
+			if r := c.handleDATA(); r != nil {
+				got = res{code: r.code, msg: r.msg}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("clientHandler.handleDATA() = %v, want %v", got, tt.want)
+			}
+
+			if originReader == nil {
+				return
+			}
+			line, err := originReader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(line, tt.wantOrigin) {
+				t.Errorf("clientHandler.handleDATA() sent %q to origin, want prefix %q", line, tt.wantOrigin)
+			}
+		})
+	}
+}
+
+func Test_dataHandler_run_auditLog(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     func(net.Conn)
+		abort      bool
+		wantStatus string
+		wantBytes  int64
+	}{
+		{
+			name: "complete",
+			client: func(conn net.Conn) {
+				io.ReadAll(io.LimitReader(conn, 4))
+				conn.Close()
+			},
+			wantStatus: "complete",
+			wantBytes:  4,
+		},
+		{
+			// write to client fails when client disconnected
+			name: "client_closed",
+			client: func(conn net.Conn) {
+				conn.Close()
+			},
+			wantStatus: "incomplete",
+		},
+		{
+			name:       "aborted",
+			abort:      true,
+			wantStatus: "incomplete",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "xferlog")
+			a, err := newAuditLogger(&auditLogConfig{Path: path, Format: auditFormatJSON})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+
+			proxyClient, client := net.Pipe()
+			proxyOrigin, origin := net.Pipe()
+			defer client.Close()
+			defer origin.Close()
+
+			d := &dataHandler{
+				clientConn:     connector{dataConn: proxyClient},
+				originConn:     connector{dataConn: proxyOrigin},
+				config:         &config{TransferTimeout: 10},
+				log:            &logger{},
+				inDataTransfer: abool.NewBool(true),
+				mutex:          &sync.Mutex{},
+				auditLog:       a,
+				transfer:       &transferRecord{},
+			}
+
+			if tt.abort {
+				d.Close()
+			} else {
+				go tt.client(client)
+				go func() {
+					origin.Write([]byte("data"))
+					origin.Close()
+				}()
+			}
+
+			err = d.run()
+			d.writeAuditLog(downloadStream, 0, err)
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &transferRecord{}
+			if err := json.Unmarshal(b, got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.wantStatus || got.Bytes != tt.wantBytes {
+				t.Errorf("dataHandler.writeAuditLog() status = %s, bytes = %d, want %s, %d", got.Status, got.Bytes, tt.wantStatus, tt.wantBytes)
+			}
+		})
+	}
+}
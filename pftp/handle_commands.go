@@ -1,13 +1,13 @@
 package pftp
 
 import (
-	"bufio"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (c *clientHandler) handleUSER() *result {
@@ -23,9 +23,150 @@ func (c *clientHandler) handleUSER() *result {
 		}
 	}
 
+	// USER before TLS can not be checked with client certificate
+	if c.clientCertAuth() && !c.controlInTLS.IsSet() {
+		return &result{
+			code: 530,
+			msg:  "TLS required. Use AUTH TLS before USER",
+			err:  fmt.Errorf("user %s sent USER without TLS on client certificate authentication", c.param),
+			log:  c.log,
+		}
+	}
+
+	// user must match client certificate. if USER has no name, use certificate user
+	if c.context.ClientCertificate != nil {
+		if len(c.certUser) == 0 {
+			return &result{
+				code: 530,
+				msg:  "Client certificate has no user name",
+				err:  fmt.Errorf("client certificate of %s has no user name", c.context.ClientCertificate.Subject),
+				log:  c.log,
+			}
+		}
+
+		if len(c.param) == 0 {
+			c.param = c.certUser
+			c.line = fmt.Sprintf("USER %s\r\n", c.param)
+		} else if c.param != c.certUser {
+			return &result{
+				code: 530,
+				msg:  "User does not match client certificate",
+				err:  fmt.Errorf("user %s does not match client certificate user %s", c.param, c.certUser),
+				log:  c.log,
+			}
+		}
+	}
+
 	c.log.user = c.param
+	c.user = c.param
+
+	// user own access lists
+	if !c.access.permitUser(c.clientIP(), c.user) {
+		return &result{
+			code: 530,
+			msg:  "Access denied for this user from your IP address",
+			err:  fmt.Errorf("user %s from %s is denied by access list", c.user, c.clientIP()),
+			log:  c.log,
+		}
+	}
+
+	// reject banned client IP and user by login failures
+	if c.bruteForce != nil && c.bruteForce.isBanned(c.clientIP(), c.user) {
+		return &result{
+			code: 530,
+			msg:  "Too many login failures. Try again later",
+			err:  fmt.Errorf("user %s from %s is banned by login failures", c.user, c.clientIP()),
+			log:  c.log,
+		}
+	}
+
+	// do not accept user and password by cleartext
+	if c.requireTLS() && !c.controlInTLS.IsSet() {
+		return &result{
+			code: 530,
+			msg:  "TLS required. Use AUTH TLS before USER",
+			err:  fmt.Errorf("user %s sent USER without TLS", c.param),
+			log:  c.log,
+		}
+	}
+
+	// decide origin server by resolver
+	if c.resolver != nil {
+		target, err := c.resolver.Resolve(c.context, c.param, c.srcIP)
+		if err != nil {
+			if errors.Is(err, ErrOriginNotFound) {
+				return &result{
+					code: 530,
+					msg:  ErrOriginNotFound.Error(),
+					err:  err,
+					log:  c.log,
+				}
+			}
+
+			return &result{
+				code: 530,
+				msg:  "I can't deal with you (origin resolve error)",
+				err:  err,
+				log:  c.log,
+			}
+		}
+
+		c.log.debug("origin resolved: %s", target.Addr)
+		c.context.RemoteAddr = target.Addr
+
+		// pool of origins resolved for the user
+		c.originPool = target.Pool
+		c.originStrategy = target.Strategy
+		if len(c.context.RemoteAddr) == 0 && len(c.originPool) > 0 {
+			c.context.RemoteAddr = c.originPool[0]
+		}
+
+		// resolved user requires TLS
+		if target.RequireTLS {
+			c.userRequireTLS = true
+			if !c.controlInTLS.IsSet() {
+				return &result{
+					code: 530,
+					msg:  "TLS required for this user. Use AUTH TLS before USER",
+					err:  fmt.Errorf("user %s requires TLS but sent USER without TLS", c.param),
+					log:  c.log,
+				}
+			}
+		}
+	}
+
+	// limit connections per user. user is counted after login
+	// and origin is counted on connect
+	if !c.underLimit(limitByUser, c.param, c.config.MaxConnsPerUser) {
+		return &result{
+			code: 530,
+			msg:  "Too many connections for this user",
+			err:  fmt.Errorf("exceeded connection limit of user %s", c.param),
+			log:  c.log,
+		}
+	}
 
 	if err := c.connectProxy(); err != nil {
+		// all origins reached connection limit
+		if errors.Is(err, errOriginConnLimit) {
+			return &result{
+				code: 421,
+				msg:  "Too many connections to origin server",
+				err:  err,
+				log:  c.log,
+			}
+		}
+
+		// origin certificate is not trusted
+		if isOriginVerifyError(err) {
+			return &result{
+				code: 421,
+				msg:  "Service not available, origin server certificate verification failed",
+				err:  err,
+				log:  c.log,
+			}
+		}
+
 		// user not found
 		if err.Error() == "user id not found" {
 			return &result{
@@ -59,8 +200,50 @@ func (c *clientHandler) handleUSER() *result {
 	return nil
 }
 
+// check user again before password, because client certificate
+// may be presented after USER
+func (c *clientHandler) handlePASS() *result {
+	if c.context.ClientCertificate != nil && c.user != c.certUser {
+		return &result{
+			code: 530,
+			msg:  "User does not match client certificate",
+			err:  fmt.Errorf("user %s does not match client certificate user %s", c.user, c.certUser),
+			log:  c.log,
+		}
+	}
+
+	// client IP or user may be banned after USER by failures of other sessions
+	if c.bruteForce != nil && c.bruteForce.isBanned(c.clientIP(), c.user) {
+		return &result{
+			code: 530,
+			msg:  "Too many login failures. Try again later",
+			err:  fmt.Errorf("user %s from %s is banned by login failures", c.user, c.clientIP()),
+			log:  c.log,
+		}
+	}
+
+	if err := c.proxy.sendToOrigin(c.line); err != nil {
+		return &result{
+			code: 530,
+			msg:  "I can't deal with you (proxy error) for user",
+			err:  err,
+			log:  c.log,
+		}
+	}
+
+	return nil
+}
+
 func (c *clientHandler) handleAUTH() *result {
 	if c.tlsDatas.forClient.getTLSConfig() != nil {
+		// already in TLS (by implicit TLS or previous AUTH)
+		if c.controlInTLS.IsSet() {
+			return &result{
+				code: 503,
+				msg:  "Already using TLS connection",
+			}
+		}
+
 		r := &result{
 			code: 234,
 			msg:  fmt.Sprintf("AUTH command ok. Expecting %s Negotiation.", c.param),
@@ -78,6 +261,7 @@ func (c *clientHandler) handleAUTH() *result {
 		tlsConn := tls.Server(c.conn, c.tlsDatas.forClient.getTLSConfig())
 		err := tlsConn.Handshake()
 		if err != nil {
+			metrics.tlsHandshakeFails.inc("client")
 			return &result{
 				code: 550,
 				msg:  "TLS Handshake Error",
@@ -86,31 +270,9 @@ func (c *clientHandler) handleAUTH() *result {
 			}
 		}
 
-		c.log.debug("TLS control connection finished with client. TLS protocol version: %s and Cipher Suite: %s", getTLSProtocolName(tlsConn.ConnectionState().Version), tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite))
-
-		c.conn = tlsConn
-		c.reader = bufio.NewReader(c.conn)
-		c.writer = bufio.NewWriter(c.conn)
-
-		// if proxy server attached, change proxy handler's client reader & writer to TLS conn
-		if c.proxy != nil {
-			c.proxy.clientReader = c.reader
-			c.proxy.clientWriter = c.writer
-		}
-
+		c.setClientTLSConn(tlsConn)
 		c.previousTLSCommands = append(c.previousTLSCommands, c.line)
 
-		c.controlInTLS.Set()
-
-		c.tlsDatas.serverName = tlsConn.ConnectionState().ServerName
-		c.tlsDatas.version = tlsConn.ConnectionState().Version
-		c.tlsDatas.cipherSuite = tlsConn.ConnectionState().CipherSuite
-
-		// set specific client TLS informations to origin TLS config
-		c.tlsDatas.forOrigin.setServerName(c.tlsDatas.serverName)
-		c.tlsDatas.forOrigin.setSpecificTLSVersion(c.tlsDatas.version)
-		c.tlsDatas.forOrigin.setCipherSUite(c.tlsDatas.cipherSuite)
-
 		return nil
 	}
 	return &result{
@@ -122,7 +284,8 @@ func (c *clientHandler) handleAUTH() *result {
 // response PBSZ to client and store command line when connect by TLS & not loggined
 func (c *clientHandler) handlePBSZ() *result {
 	if c.controlInTLS.IsSet() {
-		if !c.proxy.isLoggedIn() {
+		// origin TLS settings are decided by pftp when force origin TLS and data channel is proxied
+		if !c.proxy.isLoggedIn() || c.originTLSByProxy() {
 			r := &result{
 				code: 200,
 				msg:  fmt.Sprintf("PBSZ %s successful", c.param),
@@ -163,7 +326,8 @@ func (c *clientHandler) handlePBSZ() *result {
 // response PROT to client and store command line when connect by TLS & not loggined
 func (c *clientHandler) handlePROT() *result {
 	if c.controlInTLS.IsSet() {
-		if !c.proxy.isLoggedIn() {
+		// origin TLS settings are decided by pftp when force origin TLS and data channel is proxied
+		if !c.proxy.isLoggedIn() || c.originTLSByProxy() {
 			var r *result
 			if c.param == "C" {
 				r = &result{
@@ -229,6 +393,14 @@ func (c *clientHandler) handleTransfer() *result {
 		}
 	}
 
+	// do not transfer data by cleartext
+	if c.requireTLS() && !c.transferInTLS.IsSet() {
+		return &result{
+			code: 521,
+			msg:  "Data connection must be protected. Use PROT P",
+		}
+	}
+
 	if !c.proxy.isDataHandlerAvailable() {
 		return &result{
 			code: 425,
@@ -243,6 +415,21 @@ func (c *clientHandler) handleTransfer() *result {
 		}
 	}
 
+	// record transfer to audit log
+	if c.auditLog != nil {
+		clientIP, _, _ := net.SplitHostPort(c.srcIP)
+		c.proxy.dataConnector.auditLog = c.auditLog
+		c.proxy.dataConnector.transfer = &transferRecord{
+			Time:     time.Now(),
+			User:     c.log.user,
+			ClientIP: clientIP,
+			Origin:   c.proxy.originAddr,
+			Command:  c.command,
+			Filename: c.param,
+			TLS:      c.transferInTLS.IsSet(),
+		}
+	}
+
 	// start data transfer by direction
 	switch c.command {
 	case "RETR", "LIST", "MLSD", "NLST":
@@ -262,27 +449,14 @@ func (c *clientHandler) handleTransfer() *result {
 	return nil
 }
 
+// PROXY protocol header is read before greeting only from trusted_proxies,
+// so PROXY command is not accepted and not sent to origin
 func (c *clientHandler) handlePROXY() *result {
-	params := strings.SplitN(strings.Trim(c.line, "\r\n"), " ", 6)
-	if len(params) != 6 {
-		return &result{
-			code: 500,
-			msg:  "Proxy header parse error",
-			err:  errors.New("wrong proxy header parameters"),
-		}
-	}
-
-	if net.ParseIP(params[2]) == nil || net.ParseIP(params[3]) == nil {
-		return &result{
-			code: 500,
-			msg:  "Proxy header parse error",
-			err:  errors.New("wrong source ip address"),
-		}
+	return &result{
+		code: 500,
+		msg:  "Proxy header not accepted",
+		err:  errors.New("proxy header is accepted only before greeting"),
 	}
-
-	c.srcIP = params[2] + ":" + params[4]
-
-	return nil
 }
 
 // handle PORT, EPRT, PASV, EPSV commands when set data channel proxy is true
@@ -308,6 +482,14 @@ func (c *clientHandler) handleDATA() *result {
 			}
 		}
 
+		// PASV response can not contain IPv6 address. client should use EPSV instead
+		if c.command == "PASV" && isIPv6(c.config.MasqueradeIP) {
+			return &result{
+				code: 425,
+				msg:  "Can't open passive connection on IPv6 address, use EPSV",
+			}
+		}
+
 		// make new listener and store listener port
 		dataHandler, err := newDataHandler(
 			c.config,
@@ -380,20 +562,31 @@ func (c *clientHandler) handleDATA() *result {
 			_, lPort, _ := net.SplitHostPort(c.proxy.dataConnector.originConn.listener.Addr().String())
 			listenPort, _ := strconv.Atoi(lPort)
 
-			listenIP := strings.Split(c.proxy.GetConn().LocalAddr().String(), ":")[0]
+			listenIP, _, _ := net.SplitHostPort(c.proxy.GetConn().LocalAddr().String())
 
-			// prepare PORT command line to origin
-			// only use PORT command because connect to server support IPv4 now
-			toOriginMsg = fmt.Sprintf("PORT %s,%s,%s\r\n",
-				strings.ReplaceAll(listenIP, ".", ","),
-				strconv.Itoa(listenPort/256),
-				strconv.Itoa(listenPort%256))
-		} else {
-			if c.config.TransferMode == "CLIENT" {
-				toOriginMsg = c.command + "\r\n"
+			if isIPv6(listenIP) {
+				// PORT command can not contain IPv6 address. use EPRT command
+				toOriginMsg = fmt.Sprintf("EPRT |2|%s|%d|\r\n", listenIP, listenPort)
 			} else {
-				toOriginMsg = c.config.TransferMode + "\r\n"
+				// prepare PORT command line to origin
+				toOriginMsg = fmt.Sprintf("PORT %s,%s,%s\r\n",
+					strings.ReplaceAll(net.ParseIP(listenIP).To4().String(), ".", ","),
+					strconv.Itoa(listenPort/256),
+					strconv.Itoa(listenPort%256))
 			}
+		} else {
+			originMode := c.config.TransferMode
+			if originMode == "CLIENT" {
+				originMode = c.command
+			}
+
+			// PASV response can not contain IPv6 address. use EPSV when connected to origin by IPv6
+			originIP, _, _ := net.SplitHostPort(c.proxy.GetConn().RemoteAddr().String())
+			if originMode == "PASV" && isIPv6(originIP) {
+				originMode = "EPSV"
+			}
+
+			toOriginMsg = originMode + "\r\n"
 		}
 
 		// send command to origin
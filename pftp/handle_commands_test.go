@@ -1,16 +1,22 @@
 package pftp
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/tevino/abool"
 )
 
 func Test_clientHandler_handleAUTH(t *testing.T) {
 	type fields struct {
-		config *config
+		config    *config
+		tlsConfig *tls.Config
+		inTLS     bool
 	}
 
 	type res struct {
@@ -35,6 +41,18 @@ func Test_clientHandler_handleAUTH(t *testing.T) {
 				msg:  "Cannot get a TLS config",
 			},
 		},
+		{
+			name: "already_tls",
+			fields: fields{
+				config:    &config{ImplicitTLS: true},
+				tlsConfig: &tls.Config{},
+				inTLS:     true,
+			},
+			want: &res{
+				code: 503,
+				msg:  "Already using TLS connection",
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -42,8 +60,9 @@ func Test_clientHandler_handleAUTH(t *testing.T) {
 				config: tt.fields.config,
 				tlsDatas: &tlsDataSet{
 					forOrigin: &tlsData{},
-					forClient: &tlsData{},
+					forClient: &tlsData{config: tt.fields.tlsConfig},
 				},
+				controlInTLS: abool.NewBool(tt.fields.inTLS),
 			}
 			r := c.handleAUTH()
 			got := &res{
@@ -231,3 +250,319 @@ func Test_clientHandler_handleUSER(t *testing.T) {
 		})
 	}
 }
+
+func Test_clientHandler_handleUSER_clientCertificate(t *testing.T) {
+	tests := []struct {
+		name     string
+		certUser string
+		param    string
+		want     *result
+	}{
+		{
+			name:     "user_mismatch",
+			certUser: "prouser",
+			param:    "other",
+			want: &result{
+				code: 530,
+				msg:  "User does not match client certificate",
+			},
+		},
+		{
+			name:     "no_certificate_user",
+			certUser: "",
+			param:    "prouser",
+			want: &result{
+				code: 530,
+				msg:  "Client certificate has no user name",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clientHandler{
+				config: &config{},
+				context: &Context{
+					ClientCertificate: &x509.Certificate{},
+				},
+				log:      &logger{},
+				certUser: tt.certUser,
+				param:    tt.param,
+				line:     "USER " + tt.param + "\r\n",
+			}
+			got := c.handleUSER()
+			if got == nil || got.code != tt.want.code || got.msg != tt.want.msg {
+				t.Errorf("clientHandler.handleUSER() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_clientHandler_handleUSER_clientAuthCleartext(t *testing.T) {
+	c := &clientHandler{
+		config:       &config{TLS: &tlsPair{ClientAuth: clientAuthRequired}},
+		context:      &Context{},
+		log:          &logger{},
+		controlInTLS: abool.New(),
+		param:        "prouser",
+		line:         "USER prouser\r\n",
+	}
+
+	got := c.handleUSER()
+	if got == nil || got.code != 530 || got.msg != "TLS required. Use AUTH TLS before USER" {
+		t.Errorf("clientHandler.handleUSER() = %v, want 530", got)
+	}
+}
+
+func Test_clientHandler_handlePASS(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		certUser string
+		cert     *x509.Certificate
+		banned   string
+		wantCode int
+	}{
+		{
+			name:     "certificate_of_other_user",
+			user:     "alice",
+			certUser: "bob",
+			cert:     &x509.Certificate{},
+			wantCode: 530,
+		},
+		{
+			name:     "certificate_of_user",
+			user:     "alice",
+			certUser: "alice",
+			cert:     &x509.Certificate{},
+		},
+		{
+			name: "without_certificate",
+			user: "alice",
+		},
+		{
+			name:     "banned_ip",
+			user:     "alice",
+			banned:   "ip:192.168.10.1",
+			wantCode: 530,
+		},
+		{
+			name:     "banned_user",
+			user:     "alice",
+			banned:   "user:alice",
+			wantCode: 530,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originConn, clientConn := acceptTestConn(t)
+
+			g, err := newBruteForceGuard(&bruteForceConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.banned != "" {
+				g.entries[tt.banned] = &loginFailure{BannedUntil: time.Now().Add(time.Minute)}
+			}
+
+			c := &clientHandler{
+				context:    &Context{ClientCertificate: tt.cert},
+				log:        &logger{},
+				user:       tt.user,
+				certUser:   tt.certUser,
+				srcIP:      "192.168.10.1:53172",
+				bruteForce: g,
+				line:       "PASS secret\r\n",
+				proxy: &proxyServer{
+					originWriter: bufio.NewWriter(clientConn),
+					log:          &logger{},
+					waitingLogin: abool.New(),
+					config:       &config{},
+				},
+			}
+
+			got := c.handlePASS()
+			if tt.wantCode != 0 {
+				if got == nil || got.code != tt.wantCode {
+					t.Errorf("clientHandler.handlePASS() = %v, want %v", got, tt.wantCode)
+				}
+				return
+			}
+			if got != nil {
+				t.Fatalf("clientHandler.handlePASS() = %v, want nil", got)
+			}
+
+			line, err := bufio.NewReader(originConn).ReadString('\n')
+			if err != nil || line != "PASS secret\r\n" {
+				t.Errorf("clientHandler.handlePASS() sent %q to origin, want PASS", line)
+			}
+		})
+	}
+}
+
+func Test_clientHandler_requireTLS(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        *config
+		resolver      OriginResolver
+		controlInTLS  bool
+		transferInTLS bool
+		wantUSER      *result
+		wantTransfer  *result
+	}{
+		{
+			name:     "listener_cleartext",
+			config:   &config{RequireTLS: true},
+			wantUSER: &result{code: 530, msg: "TLS required. Use AUTH TLS before USER"},
+		},
+		{
+			name:         "listener_prot_c",
+			config:       &config{RequireTLS: true},
+			controlInTLS: true,
+			wantTransfer: &result{code: 521, msg: "Data connection must be protected. Use PROT P"},
+		},
+		{
+			name:     "user_cleartext",
+			config:   &config{},
+			resolver: &requireTLSResolver{},
+			wantUSER: &result{code: 530, msg: "TLS required for this user. Use AUTH TLS before USER"},
+		},
+		{
+			name:   "not_required",
+			config: &config{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clientHandler{
+				config:        tt.config,
+				context:       &Context{},
+				log:           &logger{},
+				resolver:      tt.resolver,
+				controlInTLS:  abool.NewBool(tt.controlInTLS),
+				transferInTLS: abool.NewBool(tt.transferInTLS),
+				param:         "prouser",
+			}
+
+			if tt.wantUSER != nil {
+				got := c.handleUSER()
+				if got == nil || got.code != tt.wantUSER.code || got.msg != tt.wantUSER.msg {
+					t.Errorf("clientHandler.handleUSER() = %v, want %v", got, tt.wantUSER)
+				}
+				return
+			}
+
+			c.proxy = &proxyServer{isLoggedin: true}
+			got := c.handleTransfer()
+			if tt.wantTransfer == nil {
+				// data handler is not available
+				if got == nil || got.code != 425 {
+					t.Errorf("clientHandler.handleTransfer() = %v, want 425", got)
+				}
+				return
+			}
+			if got == nil || got.code != tt.wantTransfer.code || got.msg != tt.wantTransfer.msg {
+				t.Errorf("clientHandler.handleTransfer() = %v, want %v", got, tt.wantTransfer)
+			}
+		})
+	}
+}
+
+type requireTLSResolver struct{}
+
+func (r *requireTLSResolver) Resolve(ctx *Context, user string, clientAddr string) (OriginTarget, error) {
+	return OriginTarget{Addr: "127.0.0.1:21", RequireTLS: true}, nil
+}
+
+func Test_clientHandler_handlePROT_forceOriginTLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     *config
+		wantOrigin string
+	}{
+		{
+			name:       "data_channel_not_proxied",
+			config:     &config{ForceOriginTLS: true},
+			wantOrigin: "PROT P\r\n",
+		},
+		{
+			name:   "data_channel_proxied",
+			config: &config{ForceOriginTLS: true, DataChanProxy: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originConn, originClient := acceptTestConn(t)
+			clientConn, client := acceptTestConn(t)
+
+			c := newClientHandler(clientConn, tt.config, nil, nil, 1, new(int32))
+			c.controlInTLS.Set()
+			c.parseLine("PROT P\r\n")
+			c.proxy = &proxyServer{
+				originWriter: bufio.NewWriter(originClient),
+				log:          &logger{},
+				waitingLogin: abool.New(),
+				config:       tt.config,
+				isLoggedin:   true,
+				stop:         true,
+			}
+
+			if got := c.handlePROT(); got != nil {
+				t.Fatalf("clientHandler.handlePROT() = %v, want nil", got)
+			}
+			if !c.transferInTLS.IsSet() {
+				t.Errorf("clientHandler.handlePROT() did not set transfer in TLS")
+			}
+
+			// command is sent to origin, or answered to client by pftp
+			var conn net.Conn = originConn
+			want := tt.wantOrigin
+			if len(want) == 0 {
+				conn, want = client, "200 Protection Set to Private.\r\n"
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != want {
+				t.Errorf("clientHandler.handlePROT() sent %q, want %q", line, want)
+			}
+		})
+	}
+}
+
+func Test_clientHandler_originTLSCommands(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *config
+		want   []string
+	}{
+		{
+			name:   "client_commands",
+			config: &config{},
+			want:   []string{"AUTH TLS\r\n", "PBSZ 0\r\n", "PROT C\r\n"},
+		},
+		{
+			name:   "force_origin_tls",
+			config: &config{ForceOriginTLS: true},
+			want:   []string{"AUTH TLS\r\n", "PBSZ 0\r\n", "PROT C\r\n"},
+		},
+		{
+			name:   "force_origin_tls_with_data_channel_proxy",
+			config: &config{ForceOriginTLS: true, DataChanProxy: true},
+			want:   []string{"AUTH TLS\r\n", "PBSZ 0\r\n", "PROT P\r\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clientHandler{
+				config:              tt.config,
+				previousTLSCommands: []string{"AUTH TLS\r\n", "PBSZ 0\r\n", "PROT C\r\n"},
+			}
+			if got := c.originTLSCommands(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("clientHandler.originTLSCommands() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package pftp
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	limitByIP     = "ip"
+	limitByUser   = "user"
+	limitByOrigin = "origin"
+)
+
+// errOriginConnLimit is returned when all origins reached max_connections_per_origin
+var errOriginConnLimit = errors.New("exceeded connection limit of origin")
+
+// errUserConnLimit is returned when logged in user reached max_connections_per_user
+var errUserConnLimit = errors.New("exceeded connection limit of user")
+
+// connLimiter counts connections of each key across all sessions
+type connLimiter struct {
+	mutex  sync.Mutex
+	counts map[string]int32
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		counts: make(map[string]int32),
+	}
+}
+
+// count up connections of key. if the count reaches max, do not count and return false.
+// max 0 means no limit
+func (l *connLimiter) acquire(key string, max int32) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if max > 0 && l.counts[key] >= max {
+		return false
+	}
+	l.counts[key]++
+
+	return true
+}
+
+// count down connections of key
+func (l *connLimiter) release(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.counts[key] <= 1 {
+		delete(l.counts, key)
+		return
+	}
+	l.counts[key]--
+}
+
+// get current connections of key
+func (l *connLimiter) count(key string) int32 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.counts[key]
+}
+
+// count the connection of the session by kind(ip, user or origin).
+// previous key of same kind is released when key is changed
+func (c *clientHandler) acquireLimit(kind string, key string, max int32) bool {
+	if c.limiter == nil {
+		return true
+	}
+
+	k := kind + ":" + key
+	current, ok := c.limitKeys[kind]
+	if ok && current == k {
+		return true
+	}
+
+	if !c.limiter.acquire(k, max) {
+		return false
+	}
+
+	if ok {
+		c.limiter.release(current)
+	}
+	c.limitKeys[kind] = k
+
+	return true
+}
+
+// check the session can count a connection of key without exceeding max.
+// key already counted by the session is always available
+func (c *clientHandler) underLimit(kind string, key string, max int32) bool {
+	if c.limiter == nil || max <= 0 {
+		return true
+	}
+
+	k := kind + ":" + key
+	if c.limitKeys[kind] == k {
+		return true
+	}
+
+	return c.limiter.count(k) < max
+}
+
+// release all connection counts of the session
+func (c *clientHandler) releaseLimits() {
+	if c.limiter == nil {
+		return
+	}
+
+	for kind, k := range c.limitKeys {
+		c.limiter.release(k)
+		delete(c.limitKeys, kind)
+	}
+}
+
+// get client IP address without port
+func (c *clientHandler) clientIP() string {
+	host, _, err := net.SplitHostPort(c.srcIP)
+	if err != nil {
+		return c.srcIP
+	}
+
+	return host
+}
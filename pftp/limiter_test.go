@@ -0,0 +1,262 @@
+package pftp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/tevino/abool"
+)
+
+func Test_connLimiter_acquire(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int32
+		acquires int
+		want     int32
+	}{
+		{
+			name:     "no_limit",
+			max:      0,
+			acquires: 10,
+			want:     10,
+		},
+		{
+			name:     "under_limit",
+			max:      5,
+			acquires: 3,
+			want:     3,
+		},
+		{
+			name:     "over_limit",
+			max:      5,
+			acquires: 10,
+			want:     5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newConnLimiter()
+
+			wg := sync.WaitGroup{}
+			for i := 0; i < tt.acquires; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					l.acquire("ip:192.168.10.1", tt.max)
+				}()
+			}
+			wg.Wait()
+
+			if got := l.count("ip:192.168.10.1"); got != tt.want {
+				t.Errorf("connLimiter.acquire() count = %v, want %v", got, tt.want)
+			}
+
+			for i := int32(0); i < tt.want; i++ {
+				l.release("ip:192.168.10.1")
+			}
+			if len(l.counts) != 0 {
+				t.Errorf("connLimiter.release() left counts %v", l.counts)
+			}
+		})
+	}
+}
+
+func Test_clientHandler_acquireLimit(t *testing.T) {
+	limiter := newConnLimiter()
+	newHandler := func() *clientHandler {
+		serverConn, clientConn := net.Pipe()
+		t.Cleanup(func() {
+			serverConn.Close()
+			clientConn.Close()
+		})
+
+		c := newClientHandler(serverConn, &config{}, nil, nil, 1, new(int32))
+		c.limiter = limiter
+		return c
+	}
+
+	first := newHandler()
+	second := newHandler()
+
+	if !first.acquireLimit(limitByUser, "prouser", 1) {
+		t.Fatal("clientHandler.acquireLimit() = false, want true")
+	}
+
+	// same key is not counted twice
+	if !first.acquireLimit(limitByUser, "prouser", 1) {
+		t.Errorf("clientHandler.acquireLimit() same key = false, want true")
+	}
+
+	if second.acquireLimit(limitByUser, "prouser", 1) {
+		t.Errorf("clientHandler.acquireLimit() over limit = true, want false")
+	}
+
+	// changing user releases previous user
+	if !first.acquireLimit(limitByUser, "anotheruser", 1) {
+		t.Fatal("clientHandler.acquireLimit() = false, want true")
+	}
+	if !second.acquireLimit(limitByUser, "prouser", 1) {
+		t.Errorf("clientHandler.acquireLimit() after release = false, want true")
+	}
+
+	first.releaseLimits()
+	second.releaseLimits()
+	if len(limiter.counts) != 0 {
+		t.Errorf("clientHandler.releaseLimits() left counts %v", limiter.counts)
+	}
+}
+
+func Test_clientHandler_acceptLogin(t *testing.T) {
+	limiter := newConnLimiter()
+	newHandler := func() *clientHandler {
+		serverConn, clientConn := net.Pipe()
+		t.Cleanup(func() {
+			serverConn.Close()
+			clientConn.Close()
+		})
+
+		c := newClientHandler(serverConn, &config{MaxConnsPerUser: 1}, nil, nil, 1, new(int32))
+		c.limiter = limiter
+		c.user = "prouser"
+		return c
+	}
+
+	first := newHandler()
+	second := newHandler()
+
+	// USER before login does not count the user
+	if !first.underLimit(limitByUser, "prouser", 1) || !second.underLimit(limitByUser, "prouser", 1) {
+		t.Fatal("clientHandler.underLimit() before login = false, want true")
+	}
+
+	if err := first.acceptLogin(); err != nil {
+		t.Fatalf("clientHandler.acceptLogin() error = %v", err)
+	}
+	if second.underLimit(limitByUser, "prouser", 1) {
+		t.Errorf("clientHandler.underLimit() after login = true, want false")
+	}
+	if err := second.acceptLogin(); !errors.Is(err, errUserConnLimit) {
+		t.Errorf("clientHandler.acceptLogin() error = %v, want %v", err, errUserConnLimit)
+	}
+}
+
+func Test_proxyServer_startProxy_loginLimit(t *testing.T) {
+	proxyOrigin, origin := net.Pipe()
+	proxyClient, client := net.Pipe()
+	defer origin.Close()
+	defer client.Close()
+
+	s := &proxyServer{
+		clientWriter:   bufio.NewWriter(proxyClient),
+		origin:         proxyOrigin,
+		originReader:   bufio.NewReader(proxyOrigin),
+		passThrough:    true,
+		mutex:          &sync.Mutex{},
+		log:            &logger{},
+		config:         &config{},
+		inDataTransfer: abool.New(),
+		waitingLogin:   abool.New(),
+		acceptLogin: func() error {
+			return fmt.Errorf("%w prouser", errUserConnLimit)
+		},
+	}
+
+	go origin.Write([]byte("230 Login successful.\r\n"))
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.startProxy()
+	}()
+
+	got, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "421 Too many connections for this user\r\n" {
+		t.Errorf("proxyServer.startProxy() response = %q, want 421", got)
+	}
+	if err := <-errc; !errors.Is(err, errUserConnLimit) {
+		t.Errorf("proxyServer.startProxy() error = %v, want %v", err, errUserConnLimit)
+	}
+	if s.isLoggedIn() {
+		t.Errorf("proxyServer.isLoggedIn() = true, want false")
+	}
+}
+
+func Test_clientHandler_originsUnderLimit(t *testing.T) {
+	limiter := newConnLimiter()
+	limiter.acquire("origin:10.0.0.1:21", 1)
+
+	full := &config{MaxConnsOrigin: 1}
+	origins := []*originCandidate{
+		{member: "10.0.0.1:21", addr: "10.0.0.1:21", config: full},
+		{member: "10.0.0.2:21", addr: "10.0.0.2:21", config: full},
+	}
+
+	tests := []struct {
+		name    string
+		origins []*originCandidate
+		counted string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "skip_full_member",
+			origins: origins,
+			want:    []string{"10.0.0.2:21"},
+		},
+		{
+			name:    "counted_by_session",
+			origins: origins,
+			counted: "10.0.0.1:21",
+			want:    []string{"10.0.0.1:21", "10.0.0.2:21"},
+		},
+		{
+			name:    "all_full",
+			origins: origins[:1],
+			wantErr: true,
+		},
+		{
+			name: "not_found",
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+
+			c := newClientHandler(serverConn, &config{}, nil, nil, 1, new(int32))
+			c.limiter = limiter
+			if len(tt.counted) > 0 {
+				c.limitKeys[limitByOrigin] = limitByOrigin + ":" + tt.counted
+			}
+
+			got, err := c.originsUnderLimit(tt.origins)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clientHandler.originsUnderLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, errOriginConnLimit) {
+					t.Errorf("clientHandler.originsUnderLimit() error = %v, want errOriginConnLimit", err)
+				}
+				return
+			}
+
+			addrs := []string{}
+			for _, o := range got {
+				addrs = append(addrs, o.addr)
+			}
+			if !reflect.DeepEqual(addrs, tt.want) {
+				t.Errorf("clientHandler.originsUnderLimit() = %v, want %v", addrs, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package pftp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxy metrics exposed by Prometheus text format
+var metrics = newMetricSet()
+
+type metricSet struct {
+	logins            *counterVec
+	commands          *counterVec
+	originResponses   *counterVec
+	transferBytes     *counterVec
+	transferDurations *histogramVec
+	tlsHandshakeFails *counterVec
+	originDialErrors  *counterVec
+	loginFailures     *counterVec
+	bans              *counterVec
+	originEjections   *counterVec
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		logins:            newCounterVec("pftp_logins_total", "Number of succeeded logins by origin.", "origin"),
+		commands:          newCounterVec("pftp_commands_total", "Number of commands from client by verb.", "command"),
+		originResponses:   newCounterVec("pftp_origin_responses_total", "Number of responses from origin by response code.", "code"),
+		transferBytes:     newCounterVec("pftp_transfer_bytes_total", "Bytes transferred on data connections by direction.", "direction"),
+		transferDurations: newHistogramVec("pftp_transfer_duration_seconds", "Duration of data transfers by direction.", "direction", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600}),
+		tlsHandshakeFails: newCounterVec("pftp_tls_handshake_failures_total", "Number of failed TLS handshakes by side.", "side"),
+		originDialErrors:  newCounterVec("pftp_origin_dial_errors_total", "Number of failed connections to origin by origin.", "origin"),
+		loginFailures:     newCounterVec("pftp_login_failures_total", "Number of failed logins by origin.", "origin"),
+		bans:              newCounterVec("pftp_bans_total", "Number of bans by login failures by kind.", "kind"),
+		originEjections:   newCounterVec("pftp_origin_ejections_total", "Number of origin ejections by connection failures by origin.", "origin"),
+	}
+}
+
+// write all metrics by Prometheus text format
+func (m *metricSet) writeTo(w io.Writer) {
+	m.logins.writeTo(w)
+	m.commands.writeTo(w)
+	m.originResponses.writeTo(w)
+	m.transferBytes.writeTo(w)
+	m.transferDurations.writeTo(w)
+	m.tlsHandshakeFails.writeTo(w)
+	m.originDialErrors.writeTo(w)
+	m.loginFailures.writeTo(w)
+	m.bans.writeTo(w)
+	m.originEjections.writeTo(w)
+}
+
+// counter with one label
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mutex  sync.Mutex
+	values map[string]*uint64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]*uint64),
+	}
+}
+
+func (v *counterVec) inc(labelValue string) {
+	v.add(labelValue, 1)
+}
+
+func (v *counterVec) add(labelValue string, n uint64) {
+	v.mutex.Lock()
+	value, ok := v.values[labelValue]
+	if !ok {
+		value = new(uint64)
+		v.values[labelValue] = value
+	}
+	v.mutex.Unlock()
+
+	atomic.AddUint64(value, n)
+}
+
+func (v *counterVec) get(labelValue string) uint64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if value, ok := v.values[labelValue]; ok {
+		return atomic.LoadUint64(value)
+	}
+	return 0
+}
+
+func (v *counterVec) writeTo(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+	for _, l := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", v.name, v.label, escapeLabel(l), atomic.LoadUint64(v.values[l]))
+	}
+}
+
+// histogram with one label
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name string, help string, label string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (v *histogramVec) observe(labelValue string, value float64) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	h, ok := v.values[labelValue]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.values[labelValue] = h
+	}
+
+	for i, b := range v.buckets {
+		if value <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (v *histogramVec) writeTo(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	for _, l := range sortedKeys(v.values) {
+		h := v.values[l]
+		for i, b := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"%g\"} %d\n", v.name, v.label, escapeLabel(l), b, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"+Inf\"} %d\n", v.name, v.label, escapeLabel(l), h.count)
+		fmt.Fprintf(w, "%s_sum{%s=\"%s\"} %g\n", v.name, v.label, escapeLabel(l), h.sum)
+		fmt.Fprintf(w, "%s_count{%s=\"%s\"} %d\n", v.name, v.label, escapeLabel(l), h.count)
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// escape label value for Prometheus text format
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// FTP commands of RFC 959, 2228, 2389, 2428, 3659 and 4217 which are counted by name
+var ftpCommands = map[string]bool{
+	"USER": true, "PASS": true, "ACCT": true, "CWD": true, "CDUP": true, "SMNT": true,
+	"QUIT": true, "REIN": true, "PORT": true, "PASV": true, "TYPE": true, "STRU": true,
+	"MODE": true, "RETR": true, "STOR": true, "STOU": true, "APPE": true, "ALLO": true,
+	"REST": true, "RNFR": true, "RNTO": true, "ABOR": true, "DELE": true, "RMD": true,
+	"MKD": true, "PWD": true, "LIST": true, "NLST": true, "SITE": true, "SYST": true,
+	"STAT": true, "HELP": true, "NOOP": true,
+	"AUTH": true, "ADAT": true, "PBSZ": true, "PROT": true, "CCC": true, "MIC": true,
+	"CONF": true, "ENC": true,
+	"FEAT": true, "OPTS": true, "EPRT": true, "EPSV": true,
+	"MDTM": true, "SIZE": true, "MLST": true, "MLSD": true,
+}
+
+// command label is limited to known FTP commands
+// for avoid too many labels by wrong commands
+func commandLabel(command string) string {
+	if _, ok := handlers[command]; ok || ftpCommands[command] {
+		return command
+	}
+
+	return "UNKNOWN"
+}
+
+// response code label is limited to 3 digits
+func responseCodeLabel(line string) string {
+	code := getCode(line)[0]
+	if len(code) != 3 {
+		return ""
+	}
+	for _, b := range code {
+		if b < '0' || b > '9' {
+			return ""
+		}
+	}
+
+	return code
+}
+
+// serve metrics by http
+func (server *FtpServer) serveMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		fmt.Fprintf(w, "# HELP pftp_current_connections Number of current client connections by listener.\n# TYPE pftp_current_connections gauge\n")
+		for _, l := range server.listeners {
+			lc, _ := l.settings()
+			fmt.Fprintf(w, "pftp_current_connections{listener=\"%s\"} %d\n", escapeLabel(lc.ListenAddr), atomic.LoadInt32(&l.currentConnection))
+		}
+
+		metrics.writeTo(w)
+	})
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(connectionTimeout) * time.Second,
+	}
+
+	return srv
+}
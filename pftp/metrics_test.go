@@ -0,0 +1,73 @@
+package pftp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_counterVec_writeTo(t *testing.T) {
+	v := newCounterVec("pftp_test_total", "Test counter.", "command")
+	v.inc("USER")
+	v.inc("PASS")
+	v.add("USER", 2)
+	v.inc(`a"b`)
+
+	want := `# HELP pftp_test_total Test counter.
+# TYPE pftp_test_total counter
+pftp_test_total{command="PASS"} 1
+pftp_test_total{command="USER"} 3
+pftp_test_total{command="a\"b"} 1
+`
+
+	var got bytes.Buffer
+	v.writeTo(&got)
+	if got.String() != want {
+		t.Errorf("counterVec.writeTo() = %v, want %v", got.String(), want)
+	}
+}
+
+func Test_histogramVec_writeTo(t *testing.T) {
+	v := newHistogramVec("pftp_test_seconds", "Test histogram.", "direction", []float64{1, 10})
+	v.observe("upload", 0.5)
+	v.observe("upload", 5)
+	v.observe("upload", 20)
+
+	want := `# HELP pftp_test_seconds Test histogram.
+# TYPE pftp_test_seconds histogram
+pftp_test_seconds_bucket{direction="upload",le="1"} 1
+pftp_test_seconds_bucket{direction="upload",le="10"} 2
+pftp_test_seconds_bucket{direction="upload",le="+Inf"} 3
+pftp_test_seconds_sum{direction="upload"} 25.5
+pftp_test_seconds_count{direction="upload"} 3
+`
+
+	var got bytes.Buffer
+	v.writeTo(&got)
+	if got.String() != want {
+		t.Errorf("histogramVec.writeTo() = %v, want %v", got.String(), want)
+	}
+}
+
+func Test_commandLabel(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: "USER", want: "USER"},
+		{command: "PWD", want: "PWD"},
+		{command: "\xff\xf4ABOR", want: "UNKNOWN"},
+		{command: "LONGCOMMAND", want: "UNKNOWN"},
+		{command: "ABCD", want: "UNKNOWN"},
+		{command: "FEAT", want: "FEAT"},
+		{command: "PBSZ", want: "PBSZ"},
+		{command: "", want: "UNKNOWN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if got := commandLabel(tt.command); got != tt.want {
+				t.Errorf("commandLabel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
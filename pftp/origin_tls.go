@@ -0,0 +1,224 @@
+package pftp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// originVerifyError is an error of origin server certificate verification
+type originVerifyError struct {
+	addr string
+	err  error
+}
+
+func (e *originVerifyError) Error() string {
+	return fmt.Sprintf("origin %s certificate verification failed: %v", e.addr, e.err)
+}
+
+func (e *originVerifyError) Unwrap() error {
+	return e.err
+}
+
+// check the error is caused by origin server certificate verification
+func isOriginVerifyError(err error) bool {
+	var verifyErr *originVerifyError
+	return errors.As(err, &verifyErr)
+}
+
+// originTLSPolicy verifies certificates of one origin
+type originTLSPolicy struct {
+	// nil roots means system roots
+	roots      *x509.CertPool
+	serverName string
+	pins       [][]byte
+	insecure   bool
+	// client certificate presented to origin
+	clientCert *tls.Certificate
+	params     tlsParams
+}
+
+// originTLSPolicies holds default policy and each origin own policies
+type originTLSPolicies struct {
+	defaultPolicy *originTLSPolicy
+	origins       map[string]*originTLSPolicy
+}
+
+func newOriginTLSPolicies(c *originTLSConfig) (*originTLSPolicies, error) {
+	defaultPolicy, err := newOriginTLSPolicy(c)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &originTLSPolicies{
+		defaultPolicy: defaultPolicy,
+		origins:       make(map[string]*originTLSPolicy),
+	}
+
+	for _, o := range c.Origins {
+		policy, err := newOriginTLSPolicy(c.forOrigin(o))
+		if err != nil {
+			return nil, err
+		}
+		p.origins[o.Addr] = policy
+	}
+
+	return p, nil
+}
+
+// add policies of [[origin]] own TLS settings based on [origin_tls].
+// origins without own settings use default policy
+func (p *originTLSPolicies) addOrigins(base *originTLSConfig, origins []*originConfig) error {
+	if base == nil {
+		base = &originTLSConfig{}
+	}
+
+	for _, o := range origins {
+		if o.TLS == nil {
+			continue
+		}
+
+		t := *o.TLS
+		t.Addr = o.Addr
+		policy, err := newOriginTLSPolicy(base.forOrigin(&t))
+		if err != nil {
+			return err
+		}
+		p.origins[o.Addr] = policy
+	}
+
+	return nil
+}
+
+func newOriginTLSPolicy(c *originTLSConfig) (*originTLSPolicy, error) {
+	p := &originTLSPolicy{
+		serverName: c.ServerName,
+		insecure:   c.Insecure,
+	}
+
+	if len(c.CACert) > 0 {
+		caCertPEM, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		p.roots = x509.NewCertPool()
+		if !p.roots.AppendCertsFromPEM(caCertPEM) {
+			return nil, fmt.Errorf("failed to parse origin CA cert %s", c.CACert)
+		}
+	}
+
+	if len(c.MinProtocol) > 0 {
+		p.params.minVersion = getTLSProtocol(c.MinProtocol)
+	}
+	if len(c.MaxProtocol) > 0 {
+		p.params.maxVersion = getTLSProtocol(c.MaxProtocol)
+	}
+	if len(c.CipherSuite) > 0 {
+		p.params.cipherSuites = getCiphers(c.CipherSuite)
+	}
+
+	if len(c.ClientCert) > 0 {
+		cert, err := loadKeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		p.clientCert = cert
+	}
+
+	for _, pin := range c.Pins {
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil {
+			return nil, err
+		}
+		p.pins = append(p.pins, b)
+	}
+
+	return p, nil
+}
+
+// get policy of origin. nil policy does not verify anything
+func (p *originTLSPolicies) get(addr string) *originTLSPolicy {
+	if p == nil {
+		return nil
+	}
+
+	if policy, ok := p.origins[addr]; ok {
+		return policy
+	}
+
+	return p.defaultPolicy
+}
+
+// get client certificate for origin. empty certificate means no certificate
+func (p *originTLSPolicy) getClientCertificate() *tls.Certificate {
+	if p == nil || p.clientCert == nil {
+		return &tls.Certificate{}
+	}
+
+	return p.clientCert
+}
+
+// get TLS parameters for origin
+func (p *originTLSPolicy) getParams() tlsParams {
+	if p == nil {
+		return tlsParams{}
+	}
+
+	return p.params
+}
+
+// verify origin certificate chain, server name and pins
+func (p *originTLSPolicy) verify(addr string, cs tls.ConnectionState) error {
+	if p == nil || p.insecure {
+		return nil
+	}
+
+	if len(cs.PeerCertificates) == 0 {
+		return &originVerifyError{addr: addr, err: errors.New("origin has no certificate")}
+	}
+
+	// SNI sent to origin may differ from the name to verify
+	name := p.serverName
+	if len(name) == 0 {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		name = host
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         p.roots,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		return &originVerifyError{addr: addr, err: err}
+	}
+
+	if len(p.pins) == 0 {
+		return nil
+	}
+
+	for _, cert := range cs.PeerCertificates {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range p.pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+	}
+
+	return &originVerifyError{addr: addr, err: errors.New("no certificate matched pins")}
+}
@@ -0,0 +1,290 @@
+package pftp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_tlsData_verifyOriginConnection(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "origin.crt")
+	keyFile := filepath.Join(dir, "origin.key")
+	writeTestCertificate(t, certFile, keyFile, "origin.example.com")
+
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name       string
+		originTLS  *originTLSConfig
+		originAddr string
+		wantErr    bool
+	}{
+		{
+			name:       "not_configured",
+			originTLS:  nil,
+			originAddr: "127.0.0.1:21",
+			wantErr:    false,
+		},
+		{
+			name:       "ca_cert",
+			originTLS:  &originTLSConfig{CACert: certFile},
+			originAddr: "origin.example.com:21",
+			wantErr:    false,
+		},
+		{
+			name:       "name_mismatch",
+			originTLS:  &originTLSConfig{CACert: certFile},
+			originAddr: "127.0.0.1:21",
+			wantErr:    true,
+		},
+		{
+			name:       "server_name_override",
+			originTLS:  &originTLSConfig{CACert: certFile, ServerName: "origin.example.com"},
+			originAddr: "127.0.0.1:21",
+			wantErr:    false,
+		},
+		{
+			name:       "system_roots",
+			originTLS:  &originTLSConfig{},
+			originAddr: "origin.example.com:21",
+			wantErr:    true,
+		},
+		{
+			name:       "insecure",
+			originTLS:  &originTLSConfig{Insecure: true},
+			originAddr: "127.0.0.1:21",
+			wantErr:    false,
+		},
+		{
+			name:       "pin_matched",
+			originTLS:  &originTLSConfig{CACert: certFile, Pins: []string{wrongPin, pin}},
+			originAddr: "origin.example.com:21",
+			wantErr:    false,
+		},
+		{
+			name:       "pin_not_matched",
+			originTLS:  &originTLSConfig{CACert: certFile, Pins: []string{wrongPin}},
+			originAddr: "origin.example.com:21",
+			wantErr:    true,
+		},
+		{
+			name: "per_origin_insecure",
+			originTLS: &originTLSConfig{
+				Origins: []*originTLSConfig{
+					{Addr: "127.0.0.1:21", Insecure: true},
+				},
+			},
+			originAddr: "127.0.0.1:21",
+			wantErr:    false,
+		},
+		{
+			name: "per_origin_other_addr",
+			originTLS: &originTLSConfig{
+				Origins: []*originTLSConfig{
+					{Addr: "127.0.0.1:21", Insecure: true},
+				},
+			},
+			originAddr: "127.0.0.2:21",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var policies *originTLSPolicies
+			if tt.originTLS != nil {
+				policies, err = newOriginTLSPolicies(tt.originTLS)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tlsData := buildTLSConfigForOrigin(nil)
+			tlsData.setOriginPolicies(policies)
+			tlsData.setOriginAddr(tt.originAddr)
+
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+
+			go func() {
+				tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{*cert}}).Handshake()
+				serverConn.Close()
+			}()
+
+			err := tls.Client(clientConn, tlsData.getTLSConfig()).Handshake()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyOriginConnection() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !isOriginVerifyError(err) {
+				t.Errorf("verifyOriginConnection() error = %v, want originVerifyError", err)
+			}
+		})
+	}
+}
+
+func Test_tlsData_getOriginClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	originCert := filepath.Join(dir, "origin.crt")
+	originKey := filepath.Join(dir, "origin.key")
+	writeTestCertificate(t, originCert, originKey, "origin.example.com")
+
+	clientCert := filepath.Join(dir, "client.crt")
+	clientKey := filepath.Join(dir, "client.key")
+	writeTestCertificate(t, clientCert, clientKey, "pftp")
+
+	serverCert, err := loadKeyPair(originCert, originKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCA, err := loadKeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.Leaf)
+
+	originTLS := &originTLSConfig{
+		Insecure: true,
+		Origins: []*originTLSConfig{
+			{Addr: "127.0.0.1:990", ClientCert: clientCert, ClientKey: clientKey},
+		},
+	}
+	policies, err := newOriginTLSPolicies(originTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		originAddr string
+		wantErr    bool
+	}{
+		{name: "client_cert", originAddr: "127.0.0.1:990", wantErr: false},
+		{name: "no_client_cert", originAddr: "127.0.0.2:990", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsData := buildTLSConfigForOrigin(nil)
+			tlsData.setOriginPolicies(policies)
+			tlsData.setOriginAddr(tt.originAddr)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			// origin requires client certificate
+			serverErr := make(chan error, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					serverErr <- err
+					return
+				}
+				defer conn.Close()
+
+				serverErr <- tls.Server(conn, &tls.Config{
+					Certificates: []tls.Certificate{*serverCert},
+					ClientAuth:   tls.RequireAndVerifyClientCert,
+					ClientCAs:    clientCAs,
+				}).Handshake()
+			}()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			tls.Client(conn, tlsData.getTLSConfig()).Handshake()
+			if err := <-serverErr; (err != nil) != tt.wantErr {
+				t.Errorf("getOriginClientCertificate() origin handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_tlsData_setOriginAddr(t *testing.T) {
+	policies, err := newOriginTLSPolicies(&originTLSConfig{
+		Origins: []*originTLSConfig{
+			{Addr: "127.0.0.1:21", MinProtocol: "TLSv1.3", MaxProtocol: "TLSv1.3"},
+			{Addr: "127.0.0.2:21", CipherSuite: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &config{
+		TLS: &tlsPair{
+			MinProtocol: "TLSv1.1",
+			MaxProtocol: "TLSv1.2",
+			CipherSuite: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		originAddr  string
+		wantMin     uint16
+		wantMax     uint16
+		wantCiphers []uint16
+	}{
+		{
+			name:        "origin_version",
+			originAddr:  "127.0.0.1:21",
+			wantMin:     tls.VersionTLS13,
+			wantMax:     tls.VersionTLS13,
+			wantCiphers: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		},
+		{
+			name:        "origin_cipher",
+			originAddr:  "127.0.0.2:21",
+			wantMin:     tls.VersionTLS11,
+			wantMax:     tls.VersionTLS12,
+			wantCiphers: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		},
+		{
+			name:        "tls_settings",
+			originAddr:  "127.0.0.3:21",
+			wantMin:     tls.VersionTLS11,
+			wantMax:     tls.VersionTLS12,
+			wantCiphers: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsData := buildTLSConfigForOrigin(c)
+			tlsData.setOriginPolicies(policies)
+			tlsData.setServerName("ftp.example.com")
+			tlsData.setOriginAddr(tt.originAddr)
+
+			got := tlsData.getTLSConfig()
+			if got.MinVersion != tt.wantMin || got.MaxVersion != tt.wantMax {
+				t.Errorf("setOriginAddr() version = %x-%x, want %x-%x", got.MinVersion, got.MaxVersion, tt.wantMin, tt.wantMax)
+			}
+			if !reflect.DeepEqual(got.CipherSuites, tt.wantCiphers) {
+				t.Errorf("setOriginAddr() cipher suites = %v, want %v", got.CipherSuites, tt.wantCiphers)
+			}
+			if got.ServerName != "ftp.example.com" {
+				t.Errorf("setOriginAddr() server name = %v, want ftp.example.com", got.ServerName)
+			}
+		})
+	}
+}
@@ -0,0 +1,674 @@
+package pftp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	poolProbeBanner = "banner"
+	poolProbeNoop   = "noop"
+	poolProbeLogin  = "login"
+
+	poolStrategyFailover       = "failover"
+	poolStrategyRoundRobin     = "round_robin"
+	poolStrategyLeastConns     = "least_connections"
+	poolStrategyWeighted       = "weighted"
+	poolStrategyConsistentHash = "consistent_hash"
+
+	// points of each member on hash ring per weight
+	hashRingReplicas = 100
+
+	// default values of origin pool
+	defaultHealthCheckTimeout = 5
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 2
+	defaultMaxDialFailures    = 3
+	defaultEjectionTime       = 30
+
+	// pool returned by resolver is forgotten when it is not returned for this time
+	resolvedPoolTTL = 10 * time.Minute
+)
+
+// originCandidate is an origin to connect with its own settings.
+// member is the address or name in pool
+type originCandidate struct {
+	member string
+	addr   string
+	config *config
+}
+
+// poolMember is a health state of one origin
+type poolMember struct {
+	addr         string
+	pool         *poolConfig
+	healthy      bool
+	successes    int
+	failures     int
+	dialFailures int
+	ejectedUntil time.Time
+	sessions     int
+}
+
+// poolState is a state of load balancing of one pool.
+// members and lastSeen are set for pool returned by resolver
+type poolState struct {
+	next           uint64
+	currentWeights map[string]int
+	ring           *hashRing
+	members        []string
+	lastSeen       time.Time
+}
+
+// hashRing is points of members for consistent hash.
+// it is built once for members of the pool
+type hashRing struct {
+	members []string
+	points  []hashPoint
+}
+
+type hashPoint struct {
+	hash uint32
+	addr string
+}
+
+// originPools holds origin pools and health states of their members.
+// unhealthy or ejected members are tried after healthy members.
+// only members of configured pools and pools returned by resolver are tracked
+type originPools struct {
+	base      *config
+	originTLS *originTLSPolicies
+	pools     map[string]*poolConfig
+	mutex     sync.Mutex
+	members   map[string]*poolMember
+	states    map[string]*poolState
+	stopChan  chan struct{}
+	wg        sync.WaitGroup
+	now       func() time.Time
+	lastPurge time.Time
+}
+
+// settings of members of pools returned by resolver
+var defaultPoolConfig = &poolConfig{
+	MaxDialFailures: defaultMaxDialFailures,
+	EjectionTime:    defaultEjectionTime,
+}
+
+func newOriginPools(c *config, originTLS *originTLSPolicies) *originPools {
+	p := &originPools{
+		base:      c,
+		originTLS: originTLS,
+		pools:     make(map[string]*poolConfig),
+		members:   make(map[string]*poolMember),
+		states:    make(map[string]*poolState),
+		stopChan:  make(chan struct{}),
+		now:       time.Now,
+		lastPurge: time.Now(),
+	}
+
+	for _, pool := range c.Pools {
+		p.pools[pool.Name] = pool
+		for _, addr := range pool.Members {
+			if _, ok := p.members[addr]; !ok {
+				p.members[addr] = &poolMember{addr: addr, pool: pool, healthy: true}
+			}
+		}
+
+		if pool.Strategy == poolStrategyConsistentHash {
+			p.state(pool.Name).ring = newHashRing(pool, pool.Members)
+		}
+	}
+
+	return p
+}
+
+// start active health checks of pools
+func (p *originPools) start() {
+	for _, pool := range p.pools {
+		if pool.HealthCheckInterval <= 0 {
+			continue
+		}
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+
+			ticker := time.NewTicker(time.Duration(pool.HealthCheckInterval) * time.Second)
+			defer ticker.Stop()
+
+			for {
+				p.check(pool)
+
+				select {
+				case <-ticker.C:
+				case <-p.stopChan:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Close stops health checks
+func (p *originPools) Close() error {
+	close(p.stopChan)
+	p.wg.Wait()
+
+	return nil
+}
+
+// get member state. nil means addr is not in any pools. must be called with lock
+func (p *originPools) member(addr string) *poolMember {
+	return p.members[addr]
+}
+
+// get sessions of member. must be called with lock
+func (p *originPools) sessions(addr string) int {
+	if m := p.member(addr); m != nil {
+		return m.sessions
+	}
+
+	return 0
+}
+
+// check addr is a member of configured pools or pools returned by resolver.
+// must be called with lock
+func (p *originPools) inPool(addr string) bool {
+	for _, pool := range p.pools {
+		if slices.Contains(pool.Members, addr) {
+			return true
+		}
+	}
+
+	for _, state := range p.states {
+		if slices.Contains(state.members, addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// track members of pool returned by resolver for target.
+// members which left all pools are not tracked anymore. must be called with lock
+func (p *originPools) trackResolved(target string, members []string) {
+	now := p.now()
+	state := p.state(target)
+	state.lastSeen = now
+
+	if !slices.Equal(state.members, members) {
+		removed := state.members
+		state.members = slices.Clone(members)
+		for _, addr := range members {
+			if p.member(addr) == nil {
+				p.members[addr] = &poolMember{addr: addr, pool: defaultPoolConfig, healthy: true}
+			}
+		}
+		p.untrack(removed)
+	}
+
+	p.purge(now)
+}
+
+// delete states of pools which are not returned by resolver for a while.
+// run once in resolvedPoolTTL. must be called with lock
+func (p *originPools) purge(now time.Time) {
+	if now.Sub(p.lastPurge) < resolvedPoolTTL {
+		return
+	}
+
+	for target, state := range p.states {
+		if _, ok := p.pools[target]; ok || now.Sub(state.lastSeen) < resolvedPoolTTL {
+			continue
+		}
+
+		delete(p.states, target)
+		p.untrack(state.members)
+	}
+	p.lastPurge = now
+}
+
+// stop tracking addrs which are not in any pools. member in use is
+// deleted when its last session is released. must be called with lock
+func (p *originPools) untrack(addrs []string) {
+	for _, addr := range addrs {
+		if m := p.member(addr); m != nil && m.sessions == 0 && !p.inPool(addr) {
+			delete(p.members, addr)
+		}
+	}
+}
+
+// get pool config by name. nil means target is not a pool
+func (p *originPools) poolConfig(target string) *poolConfig {
+	if p == nil {
+		return nil
+	}
+
+	return p.pools[target]
+}
+
+// check name is a load balancing strategy
+func isPoolStrategy(name string) bool {
+	switch name {
+	case poolStrategyFailover, poolStrategyRoundRobin, poolStrategyLeastConns, poolStrategyWeighted, poolStrategyConsistentHash:
+		return true
+	}
+
+	return false
+}
+
+// get load balancing strategy of target. strategy returned by resolver
+// is used first, and strategy of pool named target is used next
+func (p *originPools) strategy(target string, strategy string) string {
+	if strategy = strings.ToLower(strategy); isPoolStrategy(strategy) {
+		return strategy
+	}
+
+	if c := p.poolConfig(target); c != nil && len(c.Strategy) > 0 {
+		return c.Strategy
+	}
+
+	return poolStrategyFailover
+}
+
+// get origin addresses to try in order. pool is members returned by resolver.
+// if pool is empty, members of pool named target or target itself are used.
+// members are ordered by strategy and user is the key of consistent hash
+func (p *originPools) resolve(target string, pool []string, strategy string, user string) []string {
+	addrs := pool
+	if len(addrs) == 0 {
+		addrs = []string{target}
+		if c := p.poolConfig(target); c != nil {
+			addrs = c.Members
+		}
+	}
+
+	if p == nil || (len(pool) == 0 && len(addrs) < 2) {
+		return addrs
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(pool) > 0 {
+		p.trackResolved(target, pool)
+	}
+	if len(addrs) < 2 {
+		return addrs
+	}
+
+	addrs = p.order(target, addrs, strategy, user)
+
+	now := p.now()
+	available := make([]string, 0, len(addrs))
+	unavailable := []string{}
+	for _, addr := range addrs {
+		m := p.member(addr)
+		if m == nil || (m.healthy && !now.Before(m.ejectedUntil)) {
+			available = append(available, addr)
+		} else {
+			unavailable = append(unavailable, addr)
+		}
+	}
+
+	// try unavailable members when all members are down
+	return append(available, unavailable...)
+}
+
+// order members by load balancing strategy. must be called with lock
+func (p *originPools) order(target string, addrs []string, strategy string, user string) []string {
+	c := p.poolConfig(target)
+	ordered := make([]string, len(addrs))
+	copy(ordered, addrs)
+
+	switch p.strategy(target, strategy) {
+	case poolStrategyRoundRobin:
+		state := p.state(target)
+		start := int(state.next % uint64(len(ordered)))
+		state.next++
+		return append(ordered[start:], ordered[:start]...)
+	case poolStrategyLeastConns:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return p.sessions(ordered[i]) < p.sessions(ordered[j])
+		})
+		return ordered
+	case poolStrategyWeighted:
+		// smooth weighted round robin
+		state := p.state(target)
+		total := 0
+		best := 0
+		for i, addr := range ordered {
+			w := c.weight(addr)
+			total += w
+			state.currentWeights[addr] += w
+			if state.currentWeights[addr] > state.currentWeights[ordered[best]] {
+				best = i
+			}
+		}
+		state.currentWeights[ordered[best]] -= total
+
+		// others are kept in order for failover
+		selected := []string{ordered[best]}
+		for i, addr := range ordered {
+			if i != best {
+				selected = append(selected, addr)
+			}
+		}
+		return selected
+	case poolStrategyConsistentHash:
+		// members returned by resolver may be changed, so ring is rebuilt only then
+		state := p.state(target)
+		if state.ring == nil || !slices.Equal(state.ring.members, ordered) {
+			state.ring = newHashRing(c, ordered)
+		}
+		return state.ring.order(user)
+	}
+
+	return ordered
+}
+
+// get load balancing state of pool. must be called with lock
+func (p *originPools) state(target string) *poolState {
+	state, ok := p.states[target]
+	if !ok {
+		state = &poolState{currentWeights: make(map[string]int)}
+		p.states[target] = state
+	}
+
+	return state
+}
+
+// get weight of member. members not in config have weight 1
+func (c *poolConfig) weight(addr string) int {
+	if c == nil || len(c.Weights) == 0 {
+		return 1
+	}
+
+	for i, m := range c.Members {
+		if m == addr {
+			return c.Weights[i]
+		}
+	}
+
+	return 1
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func newHashRing(c *poolConfig, addrs []string) *hashRing {
+	r := &hashRing{members: addrs}
+	for _, addr := range addrs {
+		for i := 0; i < hashRingReplicas*c.weight(addr); i++ {
+			r.points = append(r.points, hashPoint{hash: hashKey(addr + "#" + strconv.Itoa(i)), addr: addr})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+
+	return r
+}
+
+// order members by walking hash ring from hash of key, so same key
+// goes to same member and only keys of removed member are moved
+func (r *hashRing) order(key string) []string {
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+
+	ordered := make([]string, 0, len(r.members))
+	seen := make(map[string]bool)
+	for i := 0; i < len(r.points) && len(ordered) < len(r.members); i++ {
+		pt := r.points[(start+i)%len(r.points)]
+		if !seen[pt.addr] {
+			seen[pt.addr] = true
+			ordered = append(ordered, pt.addr)
+		}
+	}
+
+	return ordered
+}
+
+// count session connected to member for least connections
+func (p *originPools) acquire(addr string) {
+	if p == nil || len(addr) == 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if m := p.member(addr); m != nil {
+		m.sessions++
+	}
+}
+
+// uncount session disconnected from member
+func (p *originPools) release(addr string) {
+	if p == nil || len(addr) == 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	m := p.member(addr)
+	if m == nil || m.sessions == 0 {
+		return
+	}
+
+	m.sessions--
+	if m.sessions == 0 {
+		p.untrack([]string{addr})
+	}
+}
+
+// count connection failure to pool member and eject it when failures reach max
+func (p *originPools) dialFailed(addr string) {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	m := p.member(addr)
+	if m == nil {
+		return
+	}
+
+	m.dialFailures++
+	if m.dialFailures >= m.pool.MaxDialFailures && !p.now().Before(m.ejectedUntil) {
+		m.ejectedUntil = p.now().Add(time.Duration(m.pool.EjectionTime) * time.Second)
+		m.dialFailures = 0
+
+		logrus.Warnf("origin %s is ejected until %s by connection failures", addr, m.ejectedUntil.Format(time.RFC3339))
+		metrics.originEjections.inc(addr)
+	}
+}
+
+// reset connection failures of pool member
+func (p *originPools) dialSucceeded(addr string) {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	m := p.member(addr)
+	if m == nil {
+		return
+	}
+
+	m.dialFailures = 0
+	m.ejectedUntil = time.Time{}
+}
+
+// probe all members of pool and update their health
+func (p *originPools) check(pool *poolConfig) {
+	wg := sync.WaitGroup{}
+	for _, addr := range pool.Members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// probe uses TLS and PROXY protocol settings of the origin like sessions
+			originConfig, originAddr := p.base.forOrigin(addr)
+			t := buildTLSConfigForOrigin(originConfig)
+			t.setOriginPolicies(p.originTLS)
+
+			err := probeOrigin(&originCandidate{member: addr, addr: originAddr, config: originConfig}, pool, t)
+			p.setHealth(addr, pool, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// update health of member by probe result
+func (p *originPools) setHealth(addr string, pool *poolConfig, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	m := p.member(addr)
+	if m == nil {
+		return
+	}
+
+	if err == nil {
+		m.failures = 0
+		m.successes++
+		if !m.healthy && m.successes >= pool.HealthyThreshold {
+			m.healthy = true
+			logrus.Infof("origin %s of pool %s is healthy", addr, pool.Name)
+		}
+		return
+	}
+
+	m.successes = 0
+	m.failures++
+	if m.healthy && m.failures >= pool.UnhealthyThreshold {
+		m.healthy = false
+		logrus.Warnf("origin %s of pool %s is unhealthy: %v", addr, pool.Name, err)
+	}
+}
+
+// connect to origin and check it responds 220 banner. NOOP or login is
+// also checked by probe setting. password of login probe is sent only over TLS
+func probeOrigin(o *originCandidate, pool *poolConfig, t *tlsData) error {
+	timeout := time.Duration(pool.HealthCheckTimeout) * time.Second
+
+	conn, err := net.DialTimeout("tcp", o.addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { conn.Close() }()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	t.setOriginAddr(o.addr)
+
+	// origin with PROXY protocol expects header. LOCAL means connection from proxy itself
+	if o.config.ProxyProtocol {
+		header := &proxyproto.Header{
+			Version:           byte(o.config.proxyProtocolVersion(o.addr)),
+			Command:           proxyproto.LOCAL,
+			TransportProtocol: proxyproto.UNSPEC,
+		}
+		if _, err := header.WriteTo(conn); err != nil {
+			return err
+		}
+	}
+
+	if o.config.OriginImplicit {
+		tlsConn, err := handshakeWithOrigin(conn, t)
+		if err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+
+	reader := bufio.NewReader(conn)
+	if _, err := expectResponse(reader, "220"); err != nil {
+		return err
+	}
+
+	send := func(line string, codes ...string) (string, error) {
+		if _, err := conn.Write([]byte(line + "\r\n")); err != nil {
+			return "", err
+		}
+		return expectResponse(reader, codes...)
+	}
+
+	switch pool.HealthCheckProbe {
+	case poolProbeNoop:
+		if _, err := send("NOOP", "200"); err != nil {
+			return err
+		}
+	case poolProbeLogin:
+		if _, ok := conn.(*tls.Conn); !ok {
+			if _, err := send("AUTH TLS", "234"); err != nil {
+				return fmt.Errorf("login probe needs TLS: %v", err)
+			}
+
+			tlsConn, err := handshakeWithOrigin(conn, t)
+			if err != nil {
+				return err
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+		}
+
+		code, err := send("USER "+pool.HealthCheckUser, "331", "230")
+		if err != nil {
+			return err
+		}
+
+		// password is not needed when USER responds 230
+		if code == "331" {
+			if _, err := send("PASS "+pool.HealthCheckPassword, "230"); err != nil {
+				return err
+			}
+		}
+	}
+
+	conn.Write([]byte("QUIT\r\n"))
+
+	return nil
+}
+
+// read response and return its code if it is one of codes
+func expectResponse(reader *bufio.Reader, codes ...string) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		// skip lines of multi-line response
+		if len(line) < 4 || line[3] != ' ' {
+			continue
+		}
+
+		code := line[:3]
+		for _, c := range codes {
+			if code == c {
+				return code, nil
+			}
+		}
+
+		return "", fmt.Errorf("unexpected response %s", strings.TrimSpace(line))
+	}
+}
@@ -0,0 +1,525 @@
+package pftp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+// testOrigin is a fake origin which responds banner and fixed responses of commands
+type testOrigin struct {
+	banner      string
+	responses   map[string]string
+	tlsConfig   *tls.Config // AUTH TLS is accepted when set
+	implicit    bool
+	proxyHeader bool
+}
+
+// launch fake origin which responds banner and fixed responses of commands
+func launchTestOrigin(t *testing.T, banner string, responses map[string]string) string {
+	return (&testOrigin{banner: banner, responses: responses}).launch(t)
+}
+
+func (o *testOrigin) launch(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go o.serve(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func (o *testOrigin) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if o.proxyHeader {
+		if _, err := proxyproto.Read(reader); err != nil {
+			return
+		}
+		conn = &proxyHeaderConn{Conn: conn, tcpConn: conn.(*net.TCPConn), reader: reader, remoteAddr: conn.RemoteAddr()}
+	}
+
+	if o.implicit {
+		conn = tls.Server(conn, o.tlsConfig)
+		reader = bufio.NewReader(conn)
+	}
+
+	conn.Write([]byte(o.banner))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		command := strings.Fields(line)[0]
+		switch {
+		case command == "QUIT":
+			conn.Write([]byte("221 Goodbye.\r\n"))
+			return
+		case command == "AUTH" && o.tlsConfig != nil:
+			conn.Write([]byte("234 Proceed with negotiation.\r\n"))
+			conn = tls.Server(conn, o.tlsConfig)
+			reader = bufio.NewReader(conn)
+			continue
+		}
+
+		res, ok := o.responses[command]
+		if !ok {
+			res = "502 Command not implemented.\r\n"
+		}
+		conn.Write([]byte(res))
+	}
+}
+
+// get address which refuses connection
+func closedTestAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+func Test_originPools_resolve(t *testing.T) {
+	pool := &poolConfig{
+		Name:             "backend",
+		Members:          []string{"10.0.0.1:21", "10.0.0.2:21", "10.0.0.3:21"},
+		MaxDialFailures:  2,
+		EjectionTime:     30,
+		HealthyThreshold: 1,
+	}
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := newOriginPools(&config{Pools: []*poolConfig{pool}}, nil)
+	p.now = func() time.Time { return now }
+
+	// first member is down and second member is ejected
+	p.setHealth("10.0.0.1:21", pool, net.ErrClosed)
+	p.setHealth("10.0.0.1:21", pool, net.ErrClosed)
+	p.dialFailed("10.0.0.2:21")
+	p.dialFailed("10.0.0.2:21")
+
+	tests := []struct {
+		name   string
+		target string
+		pool   []string
+		after  time.Duration
+		want   []string
+	}{
+		{
+			name:   "not_pool",
+			target: "10.0.0.9:21",
+			want:   []string{"10.0.0.9:21"},
+		},
+		{
+			name:   "pool_name",
+			target: "backend",
+			want:   []string{"10.0.0.3:21", "10.0.0.1:21", "10.0.0.2:21"},
+		},
+		{
+			name:   "ejection_expired",
+			target: "backend",
+			after:  31 * time.Second,
+			want:   []string{"10.0.0.2:21", "10.0.0.3:21", "10.0.0.1:21"},
+		},
+		{
+			name:   "resolved_pool",
+			target: "10.0.0.2:21",
+			pool:   []string{"10.0.0.2:21", "10.0.0.4:21"},
+			want:   []string{"10.0.0.4:21", "10.0.0.2:21"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Add(tt.after)
+			if got := p.resolve(tt.target, tt.pool, "", ""); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("originPools.resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// member becomes healthy again
+	p.setHealth("10.0.0.1:21", pool, nil)
+	now = time.Date(2026, 1, 1, 0, 1, 0, 0, time.UTC)
+	if got := p.resolve("backend", nil, "", ""); got[0] != "10.0.0.1:21" {
+		t.Errorf("originPools.resolve() after recovery = %v, want 10.0.0.1:21 first", got)
+	}
+}
+
+func Test_clientHandler_isPoolTarget(t *testing.T) {
+	pools := newOriginPools(&config{Pools: []*poolConfig{{Name: "backend", Members: []string{"10.0.0.1:21"}}}}, nil)
+
+	tests := []struct {
+		name   string
+		target string
+		pool   []string
+		want   bool
+	}{
+		{
+			name:   "single_origin",
+			target: "10.0.0.1:21",
+		},
+		{
+			// one member is a pool too
+			name:   "pool",
+			target: "backend",
+			want:   true,
+		},
+		{
+			name:   "resolver_pool",
+			target: "10.0.0.1:21",
+			pool:   []string{"10.0.0.1:21"},
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clientHandler{
+				context:    &Context{RemoteAddr: tt.target},
+				originPool: tt.pool,
+				pools:      pools,
+			}
+			if got := c.isPoolTarget(); got != tt.want {
+				t.Errorf("clientHandler.isPoolTarget() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_originPools_strategies(t *testing.T) {
+	members := []string{"10.0.0.1:21", "10.0.0.2:21", "10.0.0.3:21"}
+
+	tests := []struct {
+		name     string
+		pool     *poolConfig
+		target   string
+		resolved []string
+		strategy string
+		setup    func(p *originPools)
+		users    []string
+		want     []string
+	}{
+		{
+			name:  "failover",
+			pool:  &poolConfig{Strategy: poolStrategyFailover},
+			users: []string{"", "", ""},
+			want:  []string{"10.0.0.1:21", "10.0.0.1:21", "10.0.0.1:21"},
+		},
+		{
+			name:  "round_robin",
+			pool:  &poolConfig{Strategy: poolStrategyRoundRobin},
+			users: []string{"", "", "", ""},
+			want:  []string{"10.0.0.1:21", "10.0.0.2:21", "10.0.0.3:21", "10.0.0.1:21"},
+		},
+		{
+			name: "least_connections",
+			pool: &poolConfig{Strategy: poolStrategyLeastConns},
+			setup: func(p *originPools) {
+				p.acquire("10.0.0.1:21")
+				p.acquire("10.0.0.2:21")
+				p.acquire("10.0.0.2:21")
+			},
+			users: []string{""},
+			want:  []string{"10.0.0.3:21"},
+		},
+		{
+			name:  "weighted",
+			pool:  &poolConfig{Strategy: poolStrategyWeighted, Weights: []int{3, 1, 1}},
+			users: []string{"", "", "", "", ""},
+			want:  []string{"10.0.0.1:21", "10.0.0.2:21", "10.0.0.1:21", "10.0.0.3:21", "10.0.0.1:21"},
+		},
+		{
+			name:     "resolver_strategy",
+			pool:     &poolConfig{Strategy: poolStrategyFailover},
+			target:   "10.0.0.4:21",
+			resolved: []string{"10.0.0.4:21", "10.0.0.5:21"},
+			strategy: "ROUND_ROBIN",
+			users:    []string{"", "", ""},
+			want:     []string{"10.0.0.4:21", "10.0.0.5:21", "10.0.0.4:21"},
+		},
+		{
+			name:     "resolver_named_pool",
+			pool:     &poolConfig{Strategy: poolStrategyRoundRobin},
+			target:   "backend",
+			resolved: []string{"10.0.0.4:21", "10.0.0.5:21"},
+			users:    []string{"", "", ""},
+			want:     []string{"10.0.0.4:21", "10.0.0.5:21", "10.0.0.4:21"},
+		},
+		{
+			name:     "resolver_unknown_strategy",
+			pool:     &poolConfig{Strategy: poolStrategyFailover},
+			target:   "10.0.0.4:21",
+			resolved: []string{"10.0.0.4:21", "10.0.0.5:21"},
+			strategy: "random",
+			users:    []string{"", ""},
+			want:     []string{"10.0.0.4:21", "10.0.0.4:21"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.pool.Name = "backend"
+			tt.pool.Members = members
+			p := newOriginPools(&config{Pools: []*poolConfig{tt.pool}}, nil)
+			if tt.setup != nil {
+				tt.setup(p)
+			}
+
+			target := tt.target
+			if len(target) == 0 {
+				target = "backend"
+			}
+
+			got := []string{}
+			for _, user := range tt.users {
+				got = append(got, p.resolve(target, tt.resolved, tt.strategy, user)[0])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("originPools.resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_hashRing_order(t *testing.T) {
+	pool := &poolConfig{Members: []string{"10.0.0.1:21", "10.0.0.2:21", "10.0.0.3:21"}}
+	ring := newHashRing(pool, pool.Members)
+	removedRing := newHashRing(pool, pool.Members[:2])
+
+	moved := 0
+	for i := 0; i < 300; i++ {
+		user := "user" + strconv.Itoa(i)
+		got := ring.order(user)
+		if len(got) != len(pool.Members) {
+			t.Fatalf("hashRing.order() = %v, want all members", got)
+		}
+		if again := ring.order(user); !reflect.DeepEqual(got, again) {
+			t.Fatalf("hashRing.order() is not stable for %s: %v, %v", user, got, again)
+		}
+
+		// users of other members stay when one member is removed
+		removed := removedRing.order(user)
+		if got[0] != "10.0.0.3:21" && removed[0] != got[0] {
+			moved++
+		}
+	}
+
+	if moved > 0 {
+		t.Errorf("hashRing.order() moved %d users of remaining members", moved)
+	}
+}
+
+func Test_probeOrigin(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "origin.crt")
+	keyFile := filepath.Join(dir, "origin.key")
+	writeTestCertificate(t, certFile, keyFile, "origin.example.com")
+
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{*cert}}
+
+	responses := map[string]string{
+		"NOOP": "200 NOOP ok.\r\n",
+		"USER": "331 Please specify the password.\r\n",
+		"PASS": "230 Login successful.\r\n",
+	}
+	login := &poolConfig{HealthCheckProbe: poolProbeLogin, HealthCheckUser: "health", HealthCheckPassword: "secret"}
+
+	tests := []struct {
+		name      string
+		origin    *testOrigin
+		addr      string
+		config    *config
+		originTLS *originTLSConfig
+		pool      *poolConfig
+		wantErr   bool
+	}{
+		{
+			name:   "banner",
+			origin: &testOrigin{banner: "220-Welcome\r\n220 FTP server ready\r\n"},
+			pool:   &poolConfig{HealthCheckProbe: poolProbeBanner},
+		},
+		{
+			name:    "not_ready",
+			origin:  &testOrigin{banner: "421 Too many connections\r\n"},
+			pool:    &poolConfig{HealthCheckProbe: poolProbeBanner},
+			wantErr: true,
+		},
+		{
+			name:    "refused",
+			addr:    closedTestAddr(t),
+			pool:    &poolConfig{HealthCheckProbe: poolProbeBanner},
+			wantErr: true,
+		},
+		{
+			name:   "noop",
+			origin: &testOrigin{banner: "220 FTP server ready\r\n", responses: responses},
+			pool:   &poolConfig{HealthCheckProbe: poolProbeNoop},
+		},
+		{
+			name:   "proxy_header",
+			origin: &testOrigin{banner: "220 FTP server ready\r\n", responses: responses, proxyHeader: true},
+			config: &config{ProxyProtocol: true, ProxyHeader: &proxyHeaderConfig{Version: 2}},
+			pool:   &poolConfig{HealthCheckProbe: poolProbeNoop},
+		},
+		{
+			name:   "login",
+			origin: &testOrigin{banner: "220 FTP server ready\r\n", responses: responses, tlsConfig: serverTLS},
+			pool:   login,
+		},
+		{
+			name:    "login_cleartext",
+			origin:  &testOrigin{banner: "220 FTP server ready\r\n", responses: responses},
+			pool:    login,
+			wantErr: true,
+		},
+		{
+			name:    "login_failed",
+			origin:  &testOrigin{banner: "220 FTP server ready\r\n", responses: map[string]string{"USER": "530 Login incorrect.\r\n"}, tlsConfig: serverTLS},
+			pool:    login,
+			wantErr: true,
+		},
+		{
+			name:      "implicit_tls",
+			origin:    &testOrigin{banner: "220 FTP server ready\r\n", responses: responses, tlsConfig: serverTLS, implicit: true},
+			config:    &config{OriginImplicit: true},
+			originTLS: &originTLSConfig{CACert: certFile, ServerName: "origin.example.com"},
+			pool:      login,
+		},
+		{
+			name:      "implicit_tls_untrusted",
+			origin:    &testOrigin{banner: "220 FTP server ready\r\n", responses: responses, tlsConfig: serverTLS, implicit: true},
+			config:    &config{OriginImplicit: true},
+			originTLS: &originTLSConfig{},
+			pool:      &poolConfig{HealthCheckProbe: poolProbeBanner},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := tt.addr
+			if tt.origin != nil {
+				addr = tt.origin.launch(t)
+			}
+			c := tt.config
+			if c == nil {
+				c = &config{}
+			}
+
+			tlsData := buildTLSConfigForOrigin(c)
+			if tt.originTLS != nil {
+				originTLS, err := newOriginTLSPolicies(tt.originTLS)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tlsData.setOriginPolicies(originTLS)
+			}
+
+			tt.pool.HealthCheckTimeout = 1
+			if err := probeOrigin(&originCandidate{member: addr, addr: addr, config: c}, tt.pool, tlsData); (err != nil) != tt.wantErr {
+				t.Errorf("probeOrigin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_newProxyServer_failover(t *testing.T) {
+	down := closedTestAddr(t)
+	up := launchTestOrigin(t, "220 FTP server ready\r\n", nil)
+
+	c := &config{Pools: []*poolConfig{{Name: "backend", Members: []string{down, up}, MaxDialFailures: 3}}}
+	p := newOriginPools(c, nil)
+
+	s, err := newProxyServer(&proxyServerConfig{
+		tlsDatas: &tlsDataSet{forOrigin: &tlsData{}},
+		origins: []*originCandidate{
+			{member: down, addr: down, config: c},
+			{member: up, addr: up, config: c},
+		},
+		log:   &logger{},
+		pools: p,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.origin.Close()
+
+	if s.originAddr != up {
+		t.Errorf("newProxyServer() origin = %v, want %v", s.originAddr, up)
+	}
+	if got := p.member(down).dialFailures; got != 1 {
+		t.Errorf("newProxyServer() dial failures of %v = %v, want 1", down, got)
+	}
+}
+
+func Test_originPools_trackResolved(t *testing.T) {
+	pool := &poolConfig{Name: "backend", Members: []string{"10.0.0.1:21", "10.0.0.2:21"}, MaxDialFailures: 1, EjectionTime: 30}
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := newOriginPools(&config{Pools: []*poolConfig{pool}}, nil)
+	p.now = func() time.Time { return now }
+	p.lastPurge = now
+
+	// single origin is not tracked
+	p.dialFailed("10.0.0.9:21")
+	p.acquire("10.0.0.9:21")
+	if p.member("10.0.0.9:21") != nil {
+		t.Errorf("originPools tracks single origin")
+	}
+
+	// members returned by resolver are tracked while they are in the pool
+	p.resolve("10.0.1.1:21", []string{"10.0.1.1:21", "10.0.1.2:21"}, "", "prouser")
+	p.acquire("10.0.1.2:21")
+	if p.member("10.0.1.1:21") == nil || p.member("10.0.1.2:21") == nil {
+		t.Fatalf("originPools does not track members of resolved pool")
+	}
+
+	p.resolve("10.0.1.1:21", []string{"10.0.1.1:21", "10.0.1.3:21"}, "", "prouser")
+	if p.member("10.0.1.2:21") == nil {
+		t.Errorf("originPools deleted member in use")
+	}
+	p.release("10.0.1.2:21")
+	if p.member("10.0.1.2:21") != nil {
+		t.Errorf("originPools tracks member which left the pool")
+	}
+
+	// pool not returned by resolver is forgotten after ttl, but configured pool is kept
+	now = now.Add(resolvedPoolTTL + time.Second)
+	p.resolve("10.0.2.1:21", []string{"10.0.2.1:21"}, "", "prouser")
+	if p.member("10.0.1.1:21") != nil || p.member("10.0.1.3:21") != nil {
+		t.Errorf("originPools tracks members of expired pool")
+	}
+	if p.member("10.0.0.1:21") == nil || p.member("10.0.2.1:21") == nil {
+		t.Errorf("originPools deleted members of current pools")
+	}
+}
@@ -27,6 +27,8 @@ type proxyServer struct {
 	clientReader          *bufio.Reader
 	clientWriter          *bufio.Writer
 	origin                net.Conn
+	originAddr            string
+	originMember          string
 	originReader          *bufio.Reader
 	originWriter          *bufio.Writer
 	tlsDatas              *tlsDataSet
@@ -43,50 +45,72 @@ type proxyServer struct {
 	waitSwitching         chan bool
 	inDataTransfer        *abool.AtomicBool
 	isDataCommandResponse bool
+	waitingLogin          *abool.AtomicBool
+	loginResult           func(success bool) time.Duration
+	acceptLogin           func() error
+	proxyTLVs             func() []proxyproto.TLV
+	pools                 *originPools
 }
 
 type proxyServerConfig struct {
 	clientReader   *bufio.Reader
 	clientWriter   *bufio.Writer
 	tlsDatas       *tlsDataSet
-	originAddr     string
+	origins        []*originCandidate
 	mutex          *sync.Mutex
 	log            *logger
-	config         *config
 	inDataTransfer *abool.AtomicBool
+	loginResult    func(success bool) time.Duration
+	acceptLogin    func() error
+	proxyTLVs      func() []proxyproto.TLV
+	pools          *originPools
 }
 
 func newProxyServer(conf *proxyServerConfig) (*proxyServer, error) {
-	c, err := net.DialTimeout("tcp",
-		conf.originAddr,
-		time.Duration(connectionTimeout)*time.Second)
-	if err != nil {
+	var c net.Conn
+	var origin *originCandidate
+	err := errors.New("origin is not set")
+
+	// try origins in order until one of them is connected
+	for _, o := range conf.origins {
+		c, err = connectOrigin(o, conf.tlsDatas.forOrigin)
+		if err == nil {
+			conf.pools.dialSucceeded(o.member)
+			origin = o
+			break
+		}
+
+		conf.pools.dialFailed(o.member)
+		conf.log.err("cannot connect to origin %s: %v", o.addr, err)
+	}
+	if origin == nil {
 		return nil, err
 	}
 
-	// set linger 0 and tcp keepalive setting between origin connection
-	tcpConn := c.(*net.TCPConn)
-	tcpConn.SetKeepAlive(true)
-	tcpConn.SetKeepAlivePeriod(time.Duration(conf.config.KeepaliveTime) * time.Second)
-	tcpConn.SetLinger(0)
-
 	p := &proxyServer{
 		clientReader:   conf.clientReader,
 		clientWriter:   conf.clientWriter,
 		originWriter:   bufio.NewWriter(c),
 		originReader:   bufio.NewReader(c),
-		origin:         tcpConn,
+		origin:         c,
+		originAddr:     origin.addr,
+		originMember:   origin.member,
 		tlsDatas:       conf.tlsDatas,
 		passThrough:    true,
 		mutex:          conf.mutex,
 		log:            conf.log,
 		stopChan:       make(chan struct{}),
 		stopChanDone:   make(chan struct{}),
-		welcomeMsg:     "220 " + conf.config.WelcomeMsg + "\r\n",
+		welcomeMsg:     "220 " + origin.config.WelcomeMsg + "\r\n",
 		isLoggedin:     false,
-		config:         conf.config,
+		config:         origin.config,
 		waitSwitching:  make(chan bool),
 		inDataTransfer: conf.inDataTransfer,
+		waitingLogin:   abool.New(),
+		loginResult:    conf.loginResult,
+		acceptLogin:    conf.acceptLogin,
+		proxyTLVs:      conf.proxyTLVs,
+		pools:          conf.pools,
 	}
 
 	p.log.debug("new proxy from=%s to=%s", c.LocalAddr(), c.RemoteAddr())
@@ -94,6 +118,54 @@ func newProxyServer(conf *proxyServerConfig) (*proxyServer, error) {
 	return p, err
 }
 
+// connect to origin and make TLS connection if origin expects TLS handshake before welcome message
+func connectOrigin(o *originCandidate, t *tlsData) (net.Conn, error) {
+	c, err := dialOrigin(o.addr, o.config)
+	if err != nil {
+		return nil, err
+	}
+
+	t.setOriginAddr(o.addr)
+
+	if o.config.OriginImplicit {
+		tlsConn, err := handshakeWithOrigin(c, t)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	return c, nil
+}
+
+// dial to origin and set linger 0 and tcp keepalive setting between origin connection
+func dialOrigin(originAddr string, c *config) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", originAddr, time.Duration(connectionTimeout)*time.Second)
+	if err != nil {
+		metrics.originDialErrors.inc(originAddr)
+		return nil, err
+	}
+
+	tcpConn := conn.(*net.TCPConn)
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(time.Duration(c.KeepaliveTime) * time.Second)
+	tcpConn.SetLinger(0)
+
+	return tcpConn, nil
+}
+
+// SSL/TLS wrapping on origin connection
+func handshakeWithOrigin(conn net.Conn, t *tlsData) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, t.getTLSConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		metrics.tlsHandshakeFails.inc("origin")
+		return nil, fmt.Errorf("TLS handshake with origin has failed %w", err)
+	}
+
+	return tlsConn, nil
+}
+
 // check command line validation
 func (s *proxyServer) commandLineCheck(line string) (string, error) {
 	// if first byte of command line is not alphabet, delete it until start with alphabet for avoid errors
@@ -137,6 +209,11 @@ func (s *proxyServer) sendToOrigin(line string) error {
 
 	s.commandLog(line)
 
+	// wait login result of PASS from origin
+	if strings.EqualFold(getCommand(line)[0], secureCommand) {
+		s.waitingLogin.Set()
+	}
+
 	if _, err := s.originWriter.WriteString(line); err != nil {
 		s.log.err("send to origin error: %s", err.Error())
 		return err
@@ -248,44 +325,63 @@ func (s *proxyServer) sendProxyHeader(clientAddr string, originAddr string) erro
 		return err
 	}
 
-	destinationAddr, destinationPort, err := net.SplitHostPort(originAddr)
-	if err != nil {
-		return err
+	sourceIP := net.ParseIP(sourceAddr)
+	if sourceIP == nil {
+		return fmt.Errorf("client address %s is not IP address", clientAddr)
 	}
 
-	destinationPortInt, err := strconv.Atoi(destinationPort)
-	if err != nil {
-		return err
+	// destination is the address actually connected, not resolved again from origin name
+	destination, ok := s.origin.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("origin address %s is not TCP address", s.origin.RemoteAddr())
 	}
 
-	// proxyProtocolHeader's DestinationAddress must be IP! not domain name
-	hostIP, err := net.LookupIP(destinationAddr)
-	if err != nil {
-		return err
-	}
-
-	transportProtocol := proxyproto.TCPv4
-	if strings.Count(sourceAddr, ":") > 0 {
-		transportProtocol = proxyproto.TCPv6
-	}
+	transportProtocol, source, dest := proxyHeaderAddrs(&net.TCPAddr{IP: sourceIP, Port: sourcePortInt}, destination)
 
+	version := s.config.proxyProtocolVersion(originAddr)
 	proxyProtocolHeader := proxyproto.Header{
-		Version:           byte(1),
+		Version:           byte(version),
 		Command:           proxyproto.PROXY,
 		TransportProtocol: transportProtocol,
-		SourceAddr:        &net.TCPAddr{IP: net.ParseIP(sourceAddr), Port: sourcePortInt},
-		DestinationAddr:   &net.TCPAddr{IP: net.ParseIP(hostIP[0].String()), Port: destinationPortInt},
+		SourceAddr:        source,
+		DestinationAddr:   dest,
+	}
+
+	// v2 header has session ID, TLS and user informations
+	if version == 2 && s.proxyTLVs != nil {
+		if err := proxyProtocolHeader.SetTLVs(s.proxyTLVs()); err != nil {
+			return err
+		}
 	}
 
 	_, err = proxyProtocolHeader.WriteTo(s.origin)
 	return err
 }
 
+// make source and destination the same address family. when they differ,
+// IPv4 address is sent as IPv4-mapped IPv6 address
+func proxyHeaderAddrs(source *net.TCPAddr, dest *net.TCPAddr) (proxyproto.AddressFamilyAndProtocol, *net.TCPAddr, *net.TCPAddr) {
+	if source.IP.To4() != nil && dest.IP.To4() != nil {
+		return proxyproto.TCPv4,
+			&net.TCPAddr{IP: source.IP.To4(), Port: source.Port},
+			&net.TCPAddr{IP: dest.IP.To4(), Port: dest.Port}
+	}
+
+	return proxyproto.TCPv6,
+		&net.TCPAddr{IP: source.IP.To16(), Port: source.Port},
+		&net.TCPAddr{IP: dest.IP.To16(), Port: dest.Port}
+}
+
 // send command before login to origin
 func (s *proxyServer) sendTLSCommand(previousTLSCommands []string) error {
 	lastError := error(nil)
 
 	for _, cmd := range previousTLSCommands {
+		// origin connection is already TLS when origin uses implicit TLS
+		if _, ok := s.origin.(*tls.Conn); ok && strings.Compare(strings.ToUpper(getCommand(cmd)[0]), "AUTH") == 0 {
+			continue
+		}
+
 		s.commandLog(cmd)
 		if _, err := s.originWriter.WriteString(cmd); err != nil {
 			return fmt.Errorf("failed to send AUTH command to origin")
@@ -311,7 +407,7 @@ func (s *proxyServer) sendTLSCommand(previousTLSCommands []string) error {
 					// if some origins needs proxy protocol and some else is not,
 					// pftp cannot support both in same time. So, pftp ignore the
 					// 500 PROXY not understood then client can connect any servers.
-					if s.config.ProxyProtocol && strings.Contains(str, "500 PROXY") {
+					if s.config.ignoreProxyError() && strings.Contains(str, "500 PROXY") {
 						continue
 					} else {
 						lastError = fmt.Errorf("%s origin server has not support TLS connection", code)
@@ -320,10 +416,9 @@ func (s *proxyServer) sendTLSCommand(previousTLSCommands []string) error {
 					}
 				} else {
 					// SSL/TLS wrapping on connection
-					tlsConn := tls.Client(s.origin, s.tlsDatas.forOrigin.getTLSConfig())
-					err = tlsConn.Handshake()
+					tlsConn, err := handshakeWithOrigin(s.origin, s.tlsDatas.forOrigin)
 					if err != nil {
-						return fmt.Errorf("TLS handshake with origin has failed %s", err)
+						return err
 					}
 
 					s.log.debug("TLS control connection finished with origin. TLS protocol version: %s and Cipher Suite: %s", getTLSProtocolName(tlsConn.ConnectionState().Version), tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite))
@@ -343,9 +438,9 @@ func (s *proxyServer) sendTLSCommand(previousTLSCommands []string) error {
 	return lastError
 }
 
-func (s *proxyServer) switchOrigin(clientAddr string, originAddr string, previousTLSCommands []string) error {
+func (s *proxyServer) switchOrigin(clientAddr string, origins []*originCandidate, previousTLSCommands []string) error {
 	// return error when user not found
-	if len(originAddr) == 0 {
+	if len(origins) == 0 {
 		return fmt.Errorf("user id not found")
 	}
 
@@ -354,9 +449,6 @@ func (s *proxyServer) switchOrigin(clientAddr string, originAddr string, previou
 		return fmt.Errorf("origin already switched")
 	}
 
-	s.log.info("switch origin to: %s", originAddr)
-	var err error
-
 	if s.passThrough {
 		s.suspend()
 		defer s.unsuspend()
@@ -366,7 +458,7 @@ func (s *proxyServer) switchOrigin(clientAddr string, originAddr string, previou
 	s.stopChan <- struct{}{}
 	<-s.stopChanDone
 
-	lastError := error(nil)
+	var err error
 	switchResult := false
 
 	defer func() {
@@ -376,22 +468,65 @@ func (s *proxyServer) switchOrigin(clientAddr string, originAddr string, previou
 		s.waitSwitching <- switchResult
 	}()
 
+	// fail over to next origin until one of them is ready
+	for _, o := range origins {
+		s.log.info("switch origin to: %s", o.addr)
+
+		err = s.connectNewOrigin(clientAddr, o, previousTLSCommands)
+		if err == nil {
+			s.pools.dialSucceeded(o.member)
+			s.originMember = o.member
+
+			// set switch process complate
+			switchResult = true
+			return nil
+		}
+
+		s.pools.dialFailed(o.member)
+		s.log.err("cannot switch origin to %s: %v", o.addr, err)
+		if s.origin != nil {
+			s.origin.Close()
+		}
+	}
+
+	return err
+}
+
+// connect to new origin and wait for welcome message
+func (s *proxyServer) connectNewOrigin(clientAddr string, o *originCandidate, previousTLSCommands []string) error {
+	var err error
+
+	// use new origin own settings after response listener closed
+	s.config = o.config
+
 	// change connection and reset reader and writer buffer
-	s.origin, err = net.DialTimeout("tcp", originAddr, time.Duration(connectionTimeout)*time.Second)
+	s.origin, err = dialOrigin(o.addr, s.config)
 	if err != nil {
 		return err
 	}
-	s.originReader = bufio.NewReader(s.origin)
-	s.originWriter = bufio.NewWriter(s.origin)
+	s.originAddr = o.addr
+	s.tlsDatas.forOrigin.setOriginAddr(o.addr)
 
-	// Send proxy protocol v1 header when set proxy protocol true
+	// Send proxy protocol header when set proxy protocol true
 	if s.config.ProxyProtocol {
 		s.log.debug("send proxy protocol to origin")
-		if err := s.sendProxyHeader(clientAddr, originAddr); err != nil {
+		if err := s.sendProxyHeader(clientAddr, o.addr); err != nil {
+			return err
+		}
+	}
+
+	// origin expects TLS handshake before welcome message
+	if s.config.OriginImplicit {
+		tlsConn, err := handshakeWithOrigin(s.origin, s.tlsDatas.forOrigin)
+		if err != nil {
 			return err
 		}
+		s.origin = tlsConn
 	}
 
+	s.originReader = bufio.NewReader(s.origin)
+	s.originWriter = bufio.NewWriter(s.origin)
+
 	// Read welcome message from ftp connection
 	res, err := s.originReader.ReadString('\n')
 	if err != nil {
@@ -400,23 +535,13 @@ func (s *proxyServer) switchOrigin(clientAddr string, originAddr string, previou
 
 	s.log.debug("response from new origin: %s", strings.TrimSuffix(res, "\r\n"))
 
-	// set linger 0 and tcp keepalive setting between switched origin connection
-	tcpConn := s.origin.(*net.TCPConn)
-	tcpConn.SetKeepAlive(true)
-	tcpConn.SetKeepAlivePeriod(time.Duration(s.config.KeepaliveTime) * time.Second)
-	tcpConn.SetLinger(0)
-
-	s.origin = tcpConn
-
-	// If client connect with TLS connection, make TLS connection to origin ftp server too.
-	if err := s.sendTLSCommand(previousTLSCommands); err != nil {
-		return err
+	// origin which is not ready responds 421 instead of welcome message
+	if !strings.HasPrefix(res, "220") {
+		return fmt.Errorf("origin is not ready: %s", strings.TrimSuffix(res, "\r\n"))
 	}
 
-	// set switch process complate
-	switchResult = true
-
-	return lastError
+	// If client connect with TLS connection, make TLS connection to origin ftp server too.
+	return s.sendTLSCommand(previousTLSCommands)
 }
 
 func (s *proxyServer) startProxy() error {
@@ -452,6 +577,10 @@ func (s *proxyServer) startProxy() error {
 
 				s.log.debug("response from origin: %s", strings.TrimSuffix(buff, "\r\n"))
 
+				if code := responseCodeLabel(buff); len(code) > 0 {
+					metrics.originResponses.inc(code)
+				}
+
 				// response user setted welcome message
 				if strings.Compare(getCode(buff)[0], "220") == 0 && !s.isLoggedin {
 					buff = s.welcomeMsg
@@ -459,15 +588,33 @@ func (s *proxyServer) startProxy() error {
 
 				// check login and switch origin success
 				if strings.Compare(getCode(buff)[0], "230") == 0 {
+					if !s.isLoggedin {
+						// close session when the user reached connection limit
+						if err := s.checkLogin(); err != nil {
+							s.log.err(err.Error())
+							s.sendToClient("421 Too many connections for this user")
+							safeSetChanel(errchan, err)
+							break
+						}
+						metrics.logins.inc(s.originAddr)
+					}
 					s.isLoggedin = true
 				}
 
+				// delay response of failed login
+				if s.waitingLogin.IsSet() {
+					if delay := s.checkLoginResult(getCode(buff)[0]); delay > 0 {
+						s.log.debug("delay login failure response %s", delay)
+						time.Sleep(delay)
+					}
+				}
+
 				// when got 500 PROXY not understood, ignore it
 				// this ignore setting for complex origins.
 				// if some origins needs proxy protocol and some else is not,
 				// pftp cannot support both in same time. So, pftp ignore the
 				// 500 PROXY not understood then client can connect any servers.
-				if s.config.ProxyProtocol && strings.Contains(buff, "500 PROXY") {
+				if s.config.ignoreProxyError() && strings.Contains(buff, "500 PROXY") {
 					continue
 				}
 
@@ -481,7 +628,7 @@ func (s *proxyServer) startProxy() error {
 						s.isDataCommandResponse = true
 						s.dataConnector.parseEPSVresponse(buff)
 					}
-					if strings.HasPrefix(buff, "200 PORT command successful") {
+					if strings.HasPrefix(buff, "200 PORT command successful") || strings.HasPrefix(buff, "200 EPRT command successful") {
 						s.isDataCommandResponse = true
 					}
 
@@ -507,7 +654,7 @@ func (s *proxyServer) startProxy() error {
 								_, lPort, _ := net.SplitHostPort(s.dataConnector.clientConn.listener.Addr().String())
 								listenPort, _ := strconv.Atoi(lPort)
 								buff = fmt.Sprintf("227 Entering Passive Mode (%s,%s,%s).\r\n",
-									strings.ReplaceAll(s.config.MasqueradeIP, ".", ","),
+									strings.ReplaceAll(net.ParseIP(s.config.MasqueradeIP).To4().String(), ".", ","),
 									strconv.Itoa(listenPort/256),
 									strconv.Itoa(listenPort%256))
 							case "EPSV":
@@ -584,6 +731,38 @@ loop:
 	return lastError
 }
 
+// check logged in session is acceptable
+func (s *proxyServer) checkLogin() error {
+	if s.acceptLogin == nil {
+		return nil
+	}
+
+	return s.acceptLogin()
+}
+
+// notify login result of PASS and get delay before response to client
+func (s *proxyServer) checkLoginResult(code string) time.Duration {
+	switch {
+	case code == "230" || code == "202":
+		s.waitingLogin.UnSet()
+		if s.loginResult != nil {
+			s.loginResult(true)
+		}
+	case code == "530":
+		s.waitingLogin.UnSet()
+		metrics.loginFailures.inc(s.originAddr)
+		if s.loginResult != nil {
+			return s.loginResult(false)
+		}
+	case strings.HasPrefix(code, "1") || strings.HasPrefix(code, "3"):
+		// wait final response
+	default:
+		s.waitingLogin.UnSet()
+	}
+
+	return 0
+}
+
 // Hide parameters from log
 func (s *proxyServer) commandLog(line string) {
 	if strings.Compare(strings.ToUpper(getCommand(line)[0]), secureCommand) == 0 {
@@ -0,0 +1,148 @@
+package pftp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+)
+
+// proxyHeaderConn is a client connection through trusted load balancer.
+// RemoteAddr returns the client address of PROXY protocol header
+type proxyHeaderConn struct {
+	net.Conn
+	tcpConn    *net.TCPConn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+// read from buffer because it may have data after header
+func (c *proxyHeaderConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyHeaderConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyHeaderConn) CloseWrite() error {
+	return c.tcpConn.CloseWrite()
+}
+
+// check address is a trusted load balancer
+func isTrustedProxy(trustedProxies []*net.IPNet, addr net.Addr) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	return containsIP(trustedProxies, ip)
+}
+
+// read PROXY protocol v1 or v2 header sent by trusted load balancer before greeting.
+// connections from other addresses are returned as is
+func readProxyHeader(conn *net.TCPConn, c *config) (net.Conn, error) {
+	if !isTrustedProxy(c.trustedProxyNets, conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(c.ProxyHeaderTime) * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	header, err := proxyproto.Read(reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read proxy protocol header from %s: %v", conn.RemoteAddr(), err)
+	}
+
+	// LOCAL command is sent by health check of load balancer itself
+	remoteAddr := conn.RemoteAddr()
+	if header.Command.IsProxy() {
+		if _, ok := header.SourceAddr.(*net.TCPAddr); !ok {
+			return nil, fmt.Errorf("proxy protocol header from %s has unsupported source address %v", conn.RemoteAddr(), header.SourceAddr)
+		}
+		remoteAddr = header.SourceAddr
+	}
+
+	return &proxyHeaderConn{
+		Conn:       conn,
+		tcpConn:    conn,
+		reader:     reader,
+		remoteAddr: remoteAddr,
+	}, nil
+}
+
+// make random session ID to correlate logs of pftp and origin
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// make TLVs of PROXY protocol v2 header sent to origin
+func (c *clientHandler) proxyTLVs() []proxyproto.TLV {
+	tlvs := []proxyproto.TLV{}
+
+	if len(c.sessionID) > 0 {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2_TYPE_UNIQUE_ID, Value: []byte(c.sessionID)})
+	}
+
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		cs := tlsConn.ConnectionState()
+
+		// SNI sent by client
+		if len(cs.ServerName) > 0 {
+			tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte(cs.ServerName)})
+		}
+
+		ssl := tlvparse.PP2SSL{
+			Client: tlvparse.PP2_BITFIELD_CLIENT_SSL,
+			Verify: 1,
+			TLV: []proxyproto.TLV{
+				{Type: proxyproto.PP2_SUBTYPE_SSL_VERSION, Value: []byte(getTLSProtocolName(cs.Version))},
+				{Type: proxyproto.PP2_SUBTYPE_SSL_CIPHER, Value: []byte(tls.CipherSuiteName(cs.CipherSuite))},
+			},
+		}
+
+		// client certificate is already verified by verifyTLSConnection
+		if len(cs.PeerCertificates) > 0 {
+			ssl.Client |= tlvparse.PP2_BITFIELD_CLIENT_CERT_SESS
+			if !cs.DidResume {
+				ssl.Client |= tlvparse.PP2_BITFIELD_CLIENT_CERT_CONN
+			}
+			ssl.Verify = 0
+			ssl.TLV = append(ssl.TLV, proxyproto.TLV{Type: proxyproto.PP2_SUBTYPE_SSL_CN, Value: []byte(cs.PeerCertificates[0].Subject.CommonName)})
+		}
+
+		tlv, err := ssl.Marshal()
+		if err != nil {
+			c.log.err("cannot make SSL TLV of proxy protocol: %v", err)
+		} else {
+			tlvs = append(tlvs, tlv)
+		}
+	}
+
+	if len(c.user) > 0 {
+		tlvs = append(tlvs, proxyproto.TLV{Type: c.config.proxyUserTLV(), Value: []byte(c.user)})
+	}
+
+	return tlvs
+}
@@ -0,0 +1,349 @@
+package pftp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+)
+
+// accept one loopback TCP connection and return both sides
+func acceptTestConn(t *testing.T) (*net.TCPConn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	clientConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+
+	serverConn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { serverConn.Close() })
+
+	return serverConn.(*net.TCPConn), clientConn
+}
+
+func Test_readProxyHeader(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("192.168.10.1"), Port: 53172}
+	dest := &net.TCPAddr{IP: net.ParseIP("100.100.100.100"), Port: 21}
+
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		header         *proxyproto.Header
+		payload        string
+		wantAddr       string
+		wantErr        bool
+	}{
+		{
+			name:           "v1",
+			trustedProxies: []string{"127.0.0.1"},
+			header:         proxyproto.HeaderProxyFromAddrs(1, source, dest),
+			payload:        "USER prouser\r\n",
+			wantAddr:       "192.168.10.1:53172",
+		},
+		{
+			name:           "v2",
+			trustedProxies: []string{"127.0.0.0/8"},
+			header:         proxyproto.HeaderProxyFromAddrs(2, source, dest),
+			payload:        "USER prouser\r\n",
+			wantAddr:       "192.168.10.1:53172",
+		},
+		{
+			name:           "v2_local",
+			trustedProxies: []string{"127.0.0.1"},
+			header: &proxyproto.Header{
+				Version:           2,
+				Command:           proxyproto.LOCAL,
+				TransportProtocol: proxyproto.UNSPEC,
+			},
+			wantAddr: "127.0.0.1",
+		},
+		{
+			name:           "untrusted",
+			trustedProxies: []string{"192.168.0.0/16"},
+			payload:        "USER prouser\r\n",
+			wantAddr:       "127.0.0.1",
+		},
+		{
+			name:           "trusted_without_header",
+			trustedProxies: []string{"127.0.0.1"},
+			payload:        "USER prouser\r\n",
+			wantErr:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := acceptTestConn(t)
+
+			if tt.header != nil {
+				if _, err := tt.header.WriteTo(clientConn); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := clientConn.Write([]byte(tt.payload)); err != nil {
+				t.Fatal(err)
+			}
+
+			trustedProxyNets, err := parseCIDRList(tt.trustedProxies)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := readProxyHeader(serverConn, &config{trustedProxyNets: trustedProxyNets, ProxyHeaderTime: 1})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProxyHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := conn.RemoteAddr().String(); got != tt.wantAddr {
+				host, _, _ := net.SplitHostPort(got)
+				if host != tt.wantAddr {
+					t.Errorf("readProxyHeader() RemoteAddr = %v, want %v", got, tt.wantAddr)
+				}
+			}
+
+			// data after header is not lost
+			payload := make([]byte, len(tt.payload))
+			if _, err := io.ReadFull(conn, payload); err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != tt.payload {
+				t.Errorf("readProxyHeader() payload = %q, want %q", payload, tt.payload)
+			}
+		})
+	}
+}
+
+func Test_clientHandler_handlePROXY(t *testing.T) {
+	trustedProxyNets, err := parseCIDRList([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		trustedProxyNets []*net.IPNet
+		line             string
+	}{
+		{
+			name:             "trusted",
+			trustedProxyNets: trustedProxyNets,
+			line:             "PROXY TCP6 2001:db8::1 2001:db8::2 53172 21\r\n",
+		},
+		{
+			name: "untrusted",
+			line: "PROXY TCP4 192.168.10.1 100.100.100.100 53172 21\r\n",
+		},
+		{
+			name: "malformed",
+			line: "PROXY TCP4 192.168.10.256\r\n",
+		},
+	}
+
+	// header is read before greeting, so PROXY command is always rejected
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, _ := acceptTestConn(t)
+			c := newClientHandler(serverConn, &config{trustedProxyNets: tt.trustedProxyNets}, nil, nil, 1, new(int32))
+			srcIP := c.srcIP
+
+			c.parseLine(tt.line)
+			got := c.handlePROXY()
+			if got == nil || got.code != 500 || got.msg != "Proxy header not accepted" {
+				t.Errorf("clientHandler.handlePROXY() = %v, want 500 Proxy header not accepted", got)
+			}
+			if c.srcIP != srcIP {
+				t.Errorf("clientHandler.handlePROXY() changed srcIP to %v", c.srcIP)
+			}
+		})
+	}
+}
+
+func Test_proxyServer_sendProxyHeader(t *testing.T) {
+	tlvs := []proxyproto.TLV{
+		{Type: proxyproto.PP2_TYPE_UNIQUE_ID, Value: []byte("0123456789abcdef")},
+		{Type: defaultUserTLV, Value: []byte("prouser")},
+	}
+
+	tests := []struct {
+		name        string
+		proxyHeader *proxyHeaderConfig
+		wantVersion byte
+		wantTLVs    []proxyproto.TLV
+	}{
+		{
+			name:        "default_v1",
+			wantVersion: 1,
+		},
+		{
+			name:        "v2",
+			proxyHeader: &proxyHeaderConfig{Version: 2},
+			wantVersion: 2,
+			wantTLVs:    tlvs,
+		},
+		{
+			name: "origin_v1",
+			proxyHeader: &proxyHeaderConfig{
+				Version: 2,
+				Origins: []*proxyHeaderOrigin{{Addr: "127.0.0.1:21", Version: 1}},
+			},
+			wantVersion: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originConn, clientConn := acceptTestConn(t)
+
+			s := &proxyServer{
+				origin:    clientConn,
+				config:    &config{ProxyHeader: tt.proxyHeader},
+				proxyTLVs: func() []proxyproto.TLV { return tlvs },
+			}
+			if err := s.sendProxyHeader("192.168.10.1:53172", "127.0.0.1:21"); err != nil {
+				t.Fatal(err)
+			}
+
+			header, err := proxyproto.Read(bufio.NewReader(originConn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Version != tt.wantVersion {
+				t.Errorf("proxyServer.sendProxyHeader() version = %v, want %v", header.Version, tt.wantVersion)
+			}
+			if header.SourceAddr.String() != "192.168.10.1:53172" {
+				t.Errorf("proxyServer.sendProxyHeader() source = %v, want 192.168.10.1:53172", header.SourceAddr)
+			}
+
+			got, err := header.TLVs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 || len(tt.wantTLVs) != 0 {
+				if !reflect.DeepEqual(got, tt.wantTLVs) {
+					t.Errorf("proxyServer.sendProxyHeader() TLVs = %v, want %v", got, tt.wantTLVs)
+				}
+			}
+		})
+	}
+}
+
+func Test_proxyHeaderAddrs(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     string
+		dest       string
+		wantFamily proxyproto.AddressFamilyAndProtocol
+	}{
+		{name: "ipv4", source: "192.168.10.1", dest: "192.168.20.1", wantFamily: proxyproto.TCPv4},
+		{name: "ipv6", source: "2001:db8::1", dest: "2001:db8::2", wantFamily: proxyproto.TCPv6},
+		{name: "ipv4_client_ipv6_origin", source: "192.168.10.1", dest: "2001:db8::2", wantFamily: proxyproto.TCPv6},
+		{name: "ipv6_client_ipv4_origin", source: "2001:db8::1", dest: "192.168.20.1", wantFamily: proxyproto.TCPv6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			family, source, dest := proxyHeaderAddrs(
+				&net.TCPAddr{IP: net.ParseIP(tt.source), Port: 53172},
+				&net.TCPAddr{IP: net.ParseIP(tt.dest), Port: 21},
+			)
+			if family != tt.wantFamily {
+				t.Errorf("proxyHeaderAddrs() family = %v, want %v", family, tt.wantFamily)
+			}
+			if !source.IP.Equal(net.ParseIP(tt.source)) || !dest.IP.Equal(net.ParseIP(tt.dest)) {
+				t.Errorf("proxyHeaderAddrs() = %v, %v, want %v, %v", source, dest, tt.source, tt.dest)
+			}
+
+			// v2 header needs addresses of the same family
+			header := &proxyproto.Header{
+				Version:           2,
+				Command:           proxyproto.PROXY,
+				TransportProtocol: family,
+				SourceAddr:        source,
+				DestinationAddr:   dest,
+			}
+			if _, err := header.Format(); err != nil {
+				t.Errorf("proxyHeaderAddrs() makes invalid header: %v", err)
+			}
+		})
+	}
+}
+
+func Test_clientHandler_proxyTLVs(t *testing.T) {
+	dir := t.TempDir()
+	pair := &tlsPair{
+		Cert: filepath.Join(dir, "server.crt"),
+		Key:  filepath.Join(dir, "server.key"),
+	}
+	writeTestCertificate(t, pair.Cert, pair.Key, "ftp.example.com")
+
+	serverTLSData, err := buildTLSConfigForClient(pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := acceptTestConn(t)
+	go func() {
+		tlsConn := tls.Client(clientConn, &tls.Config{
+			ServerName:         "ftp.example.com",
+			InsecureSkipVerify: true,
+		})
+		tlsConn.Handshake()
+	}()
+
+	tlsConn := tls.Server(serverConn, serverTLSData.config)
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClientHandler(tlsConn, &config{}, nil, nil, 1, new(int32))
+	c.user = "prouser"
+
+	tlvs := c.proxyTLVs()
+
+	want := map[proxyproto.PP2Type]string{
+		proxyproto.PP2_TYPE_UNIQUE_ID: c.sessionID,
+		proxyproto.PP2_TYPE_AUTHORITY: "ftp.example.com",
+		defaultUserTLV:                "prouser",
+	}
+	for _, tlv := range tlvs {
+		if v, ok := want[tlv.Type]; ok {
+			if string(tlv.Value) != v {
+				t.Errorf("clientHandler.proxyTLVs() type %#x = %v, want %v", tlv.Type, string(tlv.Value), v)
+			}
+			delete(want, tlv.Type)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("clientHandler.proxyTLVs() has no TLVs %v", want)
+	}
+
+	ssl, ok := tlvparse.FindSSL(tlvs)
+	if !ok {
+		t.Fatal("clientHandler.proxyTLVs() has no SSL TLV")
+	}
+	wantVersion := getTLSProtocolName(tlsConn.ConnectionState().Version)
+	if version, _ := ssl.SSLVersion(); !ssl.ClientSSL() || version != wantVersion {
+		t.Errorf("clientHandler.proxyTLVs() SSL version = %v, want %v", version, wantVersion)
+	}
+	if cipher, ok := ssl.SSLCipher(); !ok || len(cipher) == 0 {
+		t.Errorf("clientHandler.proxyTLVs() has no SSL cipher")
+	}
+}
@@ -0,0 +1,414 @@
+package pftp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrOriginNotFound is returned by OriginResolver when origin is not found for the user
+var ErrOriginNotFound = errors.New("user id not found")
+
+// OriginTarget is the origin ftp server which user will be connected to
+type OriginTarget struct {
+	Addr string
+	// Pool is origins which serve the user. When it is set, healthy one of them is
+	// connected and next one is tried on failure. Addr is used as name of the pool
+	Pool []string
+	// Strategy is load balancing strategy of Pool like strategy of [[pool]].
+	// If empty, strategy of [[pool]] named Addr is used, or failover if no pool is named Addr
+	Strategy string
+	// RequireTLS requires AUTH TLS before USER and PROT P before transfer for the user
+	RequireTLS bool
+}
+
+// OriginResolver resolves origin ftp server from username and client address
+type OriginResolver interface {
+	Resolve(ctx *Context, user string, clientAddr string) (OriginTarget, error)
+}
+
+// StaticResolver always returns the same origin
+type StaticResolver struct {
+	addr string
+}
+
+// NewStaticResolver creates resolver which always returns addr
+func NewStaticResolver(addr string) *StaticResolver {
+	return &StaticResolver{addr: addr}
+}
+
+// Resolve returns static origin
+func (r *StaticResolver) Resolve(ctx *Context, user string, clientAddr string) (OriginTarget, error) {
+	if len(r.addr) == 0 {
+		return OriginTarget{}, ErrOriginNotFound
+	}
+
+	return OriginTarget{Addr: r.addr}, nil
+}
+
+// WebAPIResolver gets origin from web api server.
+// Response from server will contain 3 elements with JSON type.
+//
+//	{
+//	  code : http response code
+//	  message : response message from server
+//	  data : destination url
+//	  require_tls : (optional) require TLS for the user
+//	  pool : (optional) origins tried in order instead of data
+//	  strategy : (optional) load balancing strategy of pool
+//	}
+//
+// Code 404 means the user is not found. Other codes except 200 are errors
+// of the server, and cached origin is used while the server is down.
+type WebAPIResolver struct {
+	uri    string
+	client *http.Client
+}
+
+type webAPIResponse struct {
+	Code       int      `json:"code"`
+	Message    string   `json:"message"`
+	Data       string   `json:"data"`
+	RequireTLS bool     `json:"require_tls"`
+	Pool       []string `json:"pool"`
+	Strategy   string   `json:"strategy"`
+}
+
+// NewWebAPIResolver creates resolver which request to uri.
+// %s in uri is replaced by username. Request is canceled after timeout.
+func NewWebAPIResolver(uri string, timeout time.Duration) *WebAPIResolver {
+	return &WebAPIResolver{
+		uri:    uri,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Resolve requests origin to web api server
+func (r *WebAPIResolver) Resolve(ctx *Context, user string, clientAddr string) (OriginTarget, error) {
+	resp, err := r.client.Get(fmt.Sprintf(r.uri, url.QueryEscape(user)))
+	if err != nil {
+		return OriginTarget{}, err
+	}
+	defer resp.Body.Close()
+
+	// only 404 means the user has no origin. other errors are treated as
+	// web api server is not available, so cached origin can be used
+	if resp.StatusCode == http.StatusNotFound {
+		return OriginTarget{}, fmt.Errorf("%w: %s", ErrOriginNotFound, user)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return OriginTarget{}, fmt.Errorf("web api server returned %s", resp.Status)
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return OriginTarget{}, err
+	}
+
+	var decodedBody webAPIResponse
+	if err := json.Unmarshal(respBody, &decodedBody); err != nil {
+		return OriginTarget{}, fmt.Errorf("cannot decode web api response: %v", err)
+	}
+
+	switch decodedBody.Code {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return OriginTarget{}, fmt.Errorf("%w: %s", ErrOriginNotFound, decodedBody.Message)
+	default:
+		return OriginTarget{}, fmt.Errorf("web api server returned code %d: %s", decodedBody.Code, decodedBody.Message)
+	}
+
+	if len(decodedBody.Data) == 0 && len(decodedBody.Pool) == 0 {
+		return OriginTarget{}, fmt.Errorf("%w: %s", ErrOriginNotFound, decodedBody.Message)
+	}
+
+	return OriginTarget{Addr: decodedBody.Data, Pool: decodedBody.Pool, Strategy: decodedBody.Strategy, RequireTLS: decodedBody.RequireTLS}, nil
+}
+
+// FileResolver gets origin from username to origin map file.
+// File is TOML or YAML(by .yml or .yaml extension) flat map like
+//
+//	username = "127.0.0.1:10021"
+//
+// "*" key is used when the username is not in the map.
+type FileResolver struct {
+	origins map[string]string
+}
+
+// NewFileResolver loads map file and creates resolver
+func NewFileResolver(path string) (*FileResolver, error) {
+	origins := make(map[string]string)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if origins, err = parseYAMLMap(f); err != nil {
+			return nil, fmt.Errorf("cannot parse origin map file %s: %v", path, err)
+		}
+	default:
+		if _, err := toml.DecodeFile(path, &origins); err != nil {
+			return nil, fmt.Errorf("cannot parse origin map file %s: %v", path, err)
+		}
+	}
+
+	return &FileResolver{origins: origins}, nil
+}
+
+// Resolve returns origin from map
+func (r *FileResolver) Resolve(ctx *Context, user string, clientAddr string) (OriginTarget, error) {
+	if addr, ok := r.origins[user]; ok {
+		return OriginTarget{Addr: addr}, nil
+	}
+
+	if addr, ok := r.origins["*"]; ok {
+		return OriginTarget{Addr: addr}, nil
+	}
+
+	return OriginTarget{}, ErrOriginNotFound
+}
+
+// parse YAML map of username and origin
+func parseYAMLMap(r io.Reader) (map[string]string, error) {
+	m := make(map[string]string)
+	if err := yaml.NewDecoder(r).Decode(&m); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// SRVResolver gets origin from DNS SRV record.
+// %s in name is replaced by username. ex) _ftp._tcp.%s.example.com
+type SRVResolver struct {
+	name     string
+	timeout  time.Duration
+	resolver *net.Resolver
+}
+
+// NewSRVResolver creates resolver which lookup SRV record of name.
+// Lookup is canceled after timeout.
+func NewSRVResolver(name string, timeout time.Duration) *SRVResolver {
+	return &SRVResolver{
+		name:     name,
+		timeout:  timeout,
+		resolver: net.DefaultResolver,
+	}
+}
+
+// Resolve lookups SRV record and returns target which has highest priority.
+// all targets are returned as pool for failover
+func (r *SRVResolver) Resolve(ctx *Context, user string, clientAddr string) (OriginTarget, error) {
+	name := r.name
+	if strings.Contains(name, "%s") {
+		name = fmt.Sprintf(name, user)
+	}
+
+	lookupCtx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	// records are sorted by priority and randomized by weight
+	_, records, err := r.resolver.LookupSRV(lookupCtx, "", "", name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return OriginTarget{}, fmt.Errorf("%w: %s", ErrOriginNotFound, name)
+		}
+
+		return OriginTarget{}, err
+	}
+
+	if len(records) == 0 {
+		return OriginTarget{}, fmt.Errorf("%w: %s", ErrOriginNotFound, name)
+	}
+
+	pool := make([]string, 0, len(records))
+	for _, record := range records {
+		pool = append(pool, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+	}
+
+	target := OriginTarget{Addr: pool[0]}
+	if len(pool) > 1 {
+		target.Pool = pool
+	}
+
+	return target, nil
+}
+
+// CachedResolver caches results of resolver per username.
+//   - found origin is cached during ttl
+//   - ErrOriginNotFound is cached during negativeTTL
+//   - after ttl, cached origin is returned until staleTTL passed and refreshed background
+//   - when resolver got error except ErrOriginNotFound, cached origin is returned until staleTTL passed
+//
+// Concurrent resolves of same username are merged to one request.
+type CachedResolver struct {
+	resolver    OriginResolver
+	ttl         time.Duration
+	negativeTTL time.Duration
+	staleTTL    time.Duration
+	group       singleflight.Group
+	mutex       sync.Mutex
+	entries     map[string]*resolverCacheEntry
+	lastPurge   time.Time
+}
+
+type resolverCacheEntry struct {
+	target     OriginTarget
+	err        error
+	expires    time.Time
+	staleUntil time.Time
+}
+
+// NewCachedResolver creates resolver which caches results of resolver
+func NewCachedResolver(resolver OriginResolver, ttl time.Duration, negativeTTL time.Duration, staleTTL time.Duration) *CachedResolver {
+	return &CachedResolver{
+		resolver:    resolver,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		staleTTL:    staleTTL,
+		entries:     make(map[string]*resolverCacheEntry),
+		lastPurge:   time.Now(),
+	}
+}
+
+// Resolve returns cached origin or resolve by resolver
+func (r *CachedResolver) Resolve(ctx *Context, user string, clientAddr string) (OriginTarget, error) {
+	now := time.Now()
+
+	r.mutex.Lock()
+	e := r.entries[user]
+	r.mutex.Unlock()
+
+	if e != nil {
+		if now.Before(e.expires) {
+			return e.target, e.err
+		}
+
+		// return stale origin and refresh it background
+		if e.err == nil && now.Before(e.staleUntil) {
+			r.group.DoChan(user, func() (interface{}, error) {
+				return r.fetch(ctx, user, clientAddr)
+			})
+
+			return e.target, nil
+		}
+	}
+
+	v, err, _ := r.group.Do(user, func() (interface{}, error) {
+		return r.fetch(ctx, user, clientAddr)
+	})
+	if err != nil {
+		return OriginTarget{}, err
+	}
+
+	return v.(OriginTarget), nil
+}
+
+// resolve origin by resolver and store it to cache
+func (r *CachedResolver) fetch(ctx *Context, user string, clientAddr string) (OriginTarget, error) {
+	target, err := r.resolver.Resolve(ctx, user, clientAddr)
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.purge(now)
+
+	switch {
+	case err == nil:
+		r.entries[user] = &resolverCacheEntry{
+			target:     target,
+			expires:    now.Add(r.ttl),
+			staleUntil: now.Add(r.ttl + r.staleTTL),
+		}
+	case errors.Is(err, ErrOriginNotFound):
+		if r.negativeTTL > 0 {
+			r.entries[user] = &resolverCacheEntry{
+				err:     err,
+				expires: now.Add(r.negativeTTL),
+			}
+		} else {
+			delete(r.entries, user)
+		}
+	default:
+		// resolver is not available now. use stale origin if exists
+		if e := r.entries[user]; e != nil && e.err == nil && now.Before(e.staleUntil) {
+			logrus.Warnf("resolve origin of %s failed. use stale origin %s: %v", user, e.target.Addr, err)
+			return e.target, nil
+		}
+	}
+
+	return target, err
+}
+
+// delete expired entries from cache. run once in ttl
+func (r *CachedResolver) purge(now time.Time) {
+	if now.Sub(r.lastPurge) < r.ttl {
+		return
+	}
+
+	for user, e := range r.entries {
+		if now.After(e.expires) && now.After(e.staleUntil) {
+			delete(r.entries, user)
+		}
+	}
+	r.lastPurge = now
+}
+
+// make OriginResolver from resolver config
+func newOriginResolver(c *resolverConfig, remoteAddr string) (OriginResolver, error) {
+	var resolver OriginResolver
+
+	switch strings.ToLower(c.Type) {
+	case "static":
+		addr := c.Addr
+		if len(addr) == 0 {
+			addr = remoteAddr
+		}
+		resolver = NewStaticResolver(addr)
+	case "webapi":
+		resolver = NewWebAPIResolver(c.URI, time.Duration(c.Timeout)*time.Second)
+	case "file":
+		r, err := NewFileResolver(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		resolver = r
+	case "srv":
+		resolver = NewSRVResolver(c.SRVName, time.Duration(c.Timeout)*time.Second)
+	default:
+		return nil, fmt.Errorf("unknown resolver type: %s", c.Type)
+	}
+
+	if c.CacheTTL > 0 {
+		resolver = NewCachedResolver(
+			resolver,
+			time.Duration(c.CacheTTL)*time.Second,
+			time.Duration(c.NegativeCacheTTL)*time.Second,
+			time.Duration(c.StaleTTL)*time.Second,
+		)
+	}
+
+	return resolver, nil
+}
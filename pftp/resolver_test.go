@@ -0,0 +1,259 @@
+package pftp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pyama86/pftp/test"
+)
+
+func Test_WebAPIResolver_Resolve(t *testing.T) {
+	testsrv := test.LaunchUnitTestRestServer(t)
+	defer testsrv.Close()
+
+	tests := []struct {
+		name    string
+		user    string
+		want    OriginTarget
+		wantErr error
+	}{
+		{
+			name: "vsuser",
+			user: "vsuser",
+			want: OriginTarget{Addr: "127.0.0.1:10021"},
+		},
+		{
+			name: "prouser",
+			user: "prouser",
+			want: OriginTarget{Addr: "127.0.0.1:20021"},
+		},
+		{
+			name:    "not_found",
+			user:    "hogemoge",
+			wantErr: ErrOriginNotFound,
+		},
+	}
+
+	r := NewWebAPIResolver(testsrv.URL+"/getDomain?username=%s", time.Second)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Resolve(&Context{}, tt.user, "127.0.0.1:12345")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("WebAPIResolver.Resolve() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WebAPIResolver.Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_FileResolver_Resolve(t *testing.T) {
+	dir := t.TempDir()
+
+	tomlFile := filepath.Join(dir, "origins.toml")
+	if err := os.WriteFile(tomlFile, []byte(`
+vsuser = "127.0.0.1:10021"
+"*" = "127.0.0.1:21"
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	yamlFile := filepath.Join(dir, "origins.yaml")
+	if err := os.WriteFile(yamlFile, []byte(`---
+# origins
+prouser: "127.0.0.1:20021"
+vsuser: 127.0.0.1:10021 # vsftpd
+staging: &staging 127.0.0.1:30021
+devuser: *staging
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		user    string
+		want    OriginTarget
+		wantErr error
+	}{
+		{
+			name: "toml_found",
+			path: tomlFile,
+			user: "vsuser",
+			want: OriginTarget{Addr: "127.0.0.1:10021"},
+		},
+		{
+			name: "toml_default",
+			path: tomlFile,
+			user: "prouser",
+			want: OriginTarget{Addr: "127.0.0.1:21"},
+		},
+		{
+			name: "yaml_quoted",
+			path: yamlFile,
+			user: "prouser",
+			want: OriginTarget{Addr: "127.0.0.1:20021"},
+		},
+		{
+			name: "yaml_comment",
+			path: yamlFile,
+			user: "vsuser",
+			want: OriginTarget{Addr: "127.0.0.1:10021"},
+		},
+		{
+			name: "yaml_alias",
+			path: yamlFile,
+			user: "devuser",
+			want: OriginTarget{Addr: "127.0.0.1:30021"},
+		},
+		{
+			name:    "yaml_not_found",
+			path:    yamlFile,
+			user:    "hogemoge",
+			wantErr: ErrOriginNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewFileResolver(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := r.Resolve(&Context{}, tt.user, "127.0.0.1:12345")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("FileResolver.Resolve() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FileResolver.Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type countResolver struct {
+	count int32
+	wait  chan struct{}
+	err   error
+}
+
+func (r *countResolver) Resolve(ctx *Context, user string, clientAddr string) (OriginTarget, error) {
+	atomic.AddInt32(&r.count, 1)
+	if r.wait != nil {
+		<-r.wait
+	}
+	if r.err != nil {
+		return OriginTarget{}, r.err
+	}
+	return OriginTarget{Addr: user + ":21"}, nil
+}
+
+func Test_CachedResolver_Resolve(t *testing.T) {
+	t.Run("cache_hit", func(t *testing.T) {
+		backend := &countResolver{}
+		r := NewCachedResolver(backend, time.Minute, 0, 0)
+
+		for i := 0; i < 3; i++ {
+			got, err := r.Resolve(&Context{}, "vsuser", "")
+			if err != nil || got.Addr != "vsuser:21" {
+				t.Errorf("CachedResolver.Resolve() = %v, %v, want %v", got, err, "vsuser:21")
+			}
+		}
+		if backend.count != 1 {
+			t.Errorf("CachedResolver backend called %d times, want 1", backend.count)
+		}
+	})
+
+	t.Run("negative_cache", func(t *testing.T) {
+		backend := &countResolver{err: ErrOriginNotFound}
+		r := NewCachedResolver(backend, time.Minute, time.Minute, 0)
+
+		for i := 0; i < 3; i++ {
+			if _, err := r.Resolve(&Context{}, "hogemoge", ""); !errors.Is(err, ErrOriginNotFound) {
+				t.Errorf("CachedResolver.Resolve() error = %v, want %v", err, ErrOriginNotFound)
+			}
+		}
+		if backend.count != 1 {
+			t.Errorf("CachedResolver backend called %d times, want 1", backend.count)
+		}
+	})
+
+	t.Run("stale_on_error", func(t *testing.T) {
+		backend := &countResolver{}
+		r := NewCachedResolver(backend, time.Millisecond, 0, time.Minute)
+
+		if _, err := r.Resolve(&Context{}, "vsuser", ""); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		backend.err = errors.New("api server down")
+		got, err := r.fetch(&Context{}, "vsuser", "")
+		if err != nil || got.Addr != "vsuser:21" {
+			t.Errorf("CachedResolver.fetch() = %v, %v, want stale %v", got, err, "vsuser:21")
+		}
+	})
+
+	t.Run("stale_on_webapi_error", func(t *testing.T) {
+		var down atomic.Bool
+		testsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if down.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"code":500,"message":"internal server error"}`))
+				return
+			}
+			w.Write([]byte(`{"code":200,"message":"Username found","data":"127.0.0.1:10021"}`))
+		}))
+		defer testsrv.Close()
+
+		r := NewCachedResolver(NewWebAPIResolver(testsrv.URL+"/getDomain?username=%s", time.Second), time.Millisecond, time.Minute, time.Minute)
+		if _, err := r.Resolve(&Context{}, "vsuser", ""); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		down.Store(true)
+		got, err := r.fetch(&Context{}, "vsuser", "")
+		if err != nil || got.Addr != "127.0.0.1:10021" {
+			t.Errorf("CachedResolver.fetch() = %v, %v, want stale %v", got, err, "127.0.0.1:10021")
+		}
+		if e := r.entries["vsuser"]; e == nil || e.err != nil {
+			t.Errorf("CachedResolver stale entry is overwritten by %v", e)
+		}
+	})
+
+	t.Run("singleflight", func(t *testing.T) {
+		backend := &countResolver{wait: make(chan struct{})}
+		r := NewCachedResolver(backend, time.Minute, 0, 0)
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := r.Resolve(&Context{}, "vsuser", ""); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(backend.wait)
+		wg.Wait()
+
+		if backend.count != 1 {
+			t.Errorf("CachedResolver backend called %d times, want 1", backend.count)
+		}
+	})
+}
@@ -1,11 +1,15 @@
 package pftp
 
 import (
+	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -14,17 +18,67 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	// drainInterval is the interval of checking sessions on graceful shutdown
+	drainInterval = 100 * time.Millisecond
+	// drainWriteTimeout is the timeout of sending 421 to idle sessions on graceful shutdown
+	drainWriteTimeout = time.Second
+)
+
 type middlewareFunc func(*Context, string) error
 type middleware map[string]middlewareFunc
 
 // FtpServer struct type
 type FtpServer struct {
-	listener      net.Listener
+	listeners     []*ftpListener
 	clientCounter uint64
 	config        *config
-	serverTLSData *tlsData
+	confFile      string
 	middleware    middleware
-	shutdown      bool
+	resolver      OriginResolver
+	auditLog      *auditLogger
+	originTLS     *originTLSPolicies
+	limiter       *connLimiter
+	bruteForce    *bruteForceGuard
+	access        *accessControl
+	pools         *originPools
+	metricsServer *http.Server
+	shutdown      atomic.Bool
+	sessions      map[uint64]*clientHandler
+	pending       map[uint64]net.Conn
+	sessionMutex  sync.Mutex
+}
+
+// ftpListener holds listener and listener own settings
+type ftpListener struct {
+	listener          net.Listener
+	config            *config
+	serverTLSData     *tlsData
+	settingMutex      sync.RWMutex
+	currentConnection int32
+}
+
+// get current settings of listener for new session
+func (l *ftpListener) settings() (*config, *tlsData) {
+	l.settingMutex.RLock()
+	defer l.settingMutex.RUnlock()
+
+	return l.config, l.serverTLSData
+}
+
+// swap settings of listener. sessions already started keep old settings
+func (l *ftpListener) setSettings(c *config, serverTLSData *tlsData) {
+	l.settingMutex.Lock()
+	defer l.settingMutex.Unlock()
+
+	l.config = c
+	l.serverTLSData = serverTLSData
+}
+
+// accepted connection and the listener which accepted it
+type acceptedConn struct {
+	conn     *net.TCPConn
+	listener *ftpListener
 }
 
 // NewFtpServer load config and create new ftp server struct
@@ -34,7 +88,13 @@ func NewFtpServer(confFile string) (*FtpServer, error) {
 		return nil, err
 	}
 
-	return NewFtpServerFromConfig(c)
+	server, err := NewFtpServerFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	server.confFile = confFile
+
+	return server, nil
 }
 
 // NewFtpServerFromConfig creates new ftp server from the given config
@@ -43,80 +103,226 @@ func NewFtpServerFromConfig(c *config) (*FtpServer, error) {
 	server := &FtpServer{
 		config:     c,
 		middleware: m,
+		sessions:   make(map[uint64]*clientHandler),
+		pending:    make(map[uint64]net.Conn),
+		limiter:    newConnLimiter(),
+	}
+
+	// build origin resolver
+	if c.Resolver != nil {
+		resolver, err := newOriginResolver(c.Resolver, c.RemoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		server.resolver = resolver
+	}
+
+	// open audit log file
+	if c.AuditLog != nil {
+		auditLog, err := newAuditLogger(c.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+		server.auditLog = auditLog
 	}
 
-	// build and set TLS configuration
-	if server.config.TLS != nil {
-		logrus.Info("build server TLS configurations...")
-		serverTLSData, err := buildTLSConfigForClient(server.config.TLS)
+	// build access lists. lists are replaced on reload
+	access, err := newAccessControl(c.Access)
+	if err != nil {
+		return nil, err
+	}
+	server.access = access
+
+	// build login failure protection
+	if c.BruteForce != nil {
+		bruteForce, err := newBruteForceGuard(c.BruteForce)
 		if err != nil {
 			return nil, err
 		}
-		server.serverTLSData = serverTLSData
-		logrus.Infof("TLS certificate successfully loaded")
+		server.bruteForce = bruteForce
+	}
+
+	// build origin certificate verification policies
+	if c.OriginTLS != nil {
+		originTLS, err := newOriginTLSPolicies(c.OriginTLS)
+		if err != nil {
+			return nil, err
+		}
+		server.originTLS = originTLS
+	} else {
+		logrus.Warn("origin server certificates are not verified. set [origin_tls] to verify them")
+		server.originTLS = &originTLSPolicies{origins: make(map[string]*originTLSPolicy)}
+	}
+
+	// add [[origin]] own TLS policies
+	if err := server.originTLS.addOrigins(c.OriginTLS, c.Origins); err != nil {
+		return nil, err
+	}
+
+	// build origin pools. health checks run while serving
+	server.pools = newOriginPools(c, server.originTLS)
+
+	for _, lc := range c.listenerConfigs() {
+		l := &ftpListener{
+			config: lc,
+		}
+
+		// build and set TLS configuration
+		serverTLSData, err := buildListenerTLSData(lc)
+		if err != nil {
+			return nil, err
+		}
+		l.serverTLSData = serverTLSData
+
+		server.listeners = append(server.listeners, l)
 	}
 
 	return server, nil
 }
 
+// build TLS configuration for client by listener config
+func buildListenerTLSData(lc *config) (*tlsData, error) {
+	if lc.TLS == nil {
+		return nil, nil
+	}
+
+	logrus.Infof("build server TLS configurations for %s...", lc.ListenAddr)
+	serverTLSData, err := buildTLSConfigForClient(lc.TLS)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("TLS certificate successfully loaded")
+
+	// reload certificate when files are rotated
+	serverTLSData.watchCertificate(lc.TLS, certWatchInterval)
+
+	return serverTLSData, nil
+}
+
 // Use set middleware function
 func (server *FtpServer) Use(command string, m middlewareFunc) {
 	server.middleware[strings.ToUpper(command)] = m
 }
 
+// SetOriginResolver set resolver which decides origin server by USER command
+func (server *FtpServer) SetOriginResolver(r OriginResolver) {
+	server.resolver = r
+}
+
 func (server *FtpServer) listen() (err error) {
 	if os.Getenv("SERVER_STARTER_PORT") != "" {
 		listeners, err := listener.ListenAll()
 		if listeners == nil || err != nil {
 			return err
 		}
-		server.listener = listeners[0]
+		if len(listeners) < len(server.listeners) {
+			return fmt.Errorf("server starter passed %d listeners but %d listeners are configured", len(listeners), len(server.listeners))
+		}
+
+		// listeners are assigned by configured order
+		for i, l := range server.listeners {
+			l.listener = listeners[i]
+		}
 	} else {
-		l, err := net.Listen("tcp", server.config.ListenAddr)
-		if err != nil {
-			return err
+		for _, l := range server.listeners {
+			nl, err := net.Listen("tcp", l.config.ListenAddr)
+			if err != nil {
+				return err
+			}
+			l.listener = nl
 		}
-		server.listener = l
 	}
 
-	logrus.Info("Listening address ", server.listener.Addr())
+	for _, l := range server.listeners {
+		logrus.Info("Listening address ", l.listener.Addr())
+	}
 
 	return err
 }
 
-func (server *FtpServer) serve() error {
-	currentConnection := int32(0)
-	eg := errgroup.Group{}
-
+// accept connections and send them to serve loop
+func (server *FtpServer) accept(l *ftpListener, accepted chan<- *acceptedConn) error {
 	for {
-		netConn, err := server.listener.Accept()
+		netConn, err := l.listener.Accept()
 		if err != nil {
 			// if use server starter, break for while all childs end
-			if os.Getenv("SERVER_STARTER_PORT") != "" {
-				logrus.Info("Close listener")
-				break
+			if os.Getenv("SERVER_STARTER_PORT") != "" || server.shutdown.Load() {
+				logrus.Info("Close listener ", l.listener.Addr())
+				return nil
 			}
 
-			if server.listener != nil {
-				return err
-			}
+			return err
 		}
 
-		// set linger 0 and tcp keepalive setting between client connection
-		conn := netConn.(*net.TCPConn)
-		conn.SetKeepAlive(true)
-		conn.SetKeepAlivePeriod(time.Duration(server.config.KeepaliveTime) * time.Second)
-		conn.SetLinger(0)
-
-		if server.config.IdleTimeout > 0 {
-			conn.SetDeadline(time.Now().Add(time.Duration(server.config.IdleTimeout) * time.Second))
+		accepted <- &acceptedConn{
+			conn:     netConn.(*net.TCPConn),
+			listener: l,
 		}
+	}
+}
+
+func (server *FtpServer) serve() error {
+	server.pools.start()
+
+	eg := errgroup.Group{}
+	acceptGroup := errgroup.Group{}
+	accepted := make(chan *acceptedConn)
+
+	for _, l := range server.listeners {
+		acceptGroup.Go(func() error { return server.accept(l, accepted) })
+	}
+
+	acceptErr := make(chan error, 1)
+	go func() {
+		acceptErr <- acceptGroup.Wait()
+		close(accepted)
+	}()
+
+	for a := range accepted {
+		l := a.listener
+
+		// session uses the settings at accepted time even if config is reloaded
+		lc, serverTLSData := l.settings()
+
+		// set linger 0 and tcp keepalive setting between client connection
+		tcpConn := a.conn
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(time.Duration(lc.KeepaliveTime) * time.Second)
+		tcpConn.SetLinger(0)
 
 		server.clientCounter++
+		id := server.clientCounter
+
+		// register connection before reading PROXY protocol header, so drain can close it
+		server.addPending(id, tcpConn)
 
-		c := newClientHandler(conn, server.config, server.serverTLSData, server.middleware, server.clientCounter, &currentConnection)
 		eg.Go(func() error {
-			err := c.handleCommands()
+			// read PROXY protocol header before greeting. it does not block other accepts
+			conn, err := readProxyHeader(tcpConn, lc)
+			if err != nil {
+				server.removePending(id)
+				logrus.Error(err.Error())
+				tcpConn.Close()
+				return nil
+			}
+
+			if lc.IdleTimeout > 0 {
+				conn.SetDeadline(time.Now().Add(time.Duration(lc.IdleTimeout) * time.Second))
+			}
+
+			c := newClientHandler(conn, lc, serverTLSData, server.middleware, id, &l.currentConnection)
+			c.resolver = server.resolver
+			c.auditLog = server.auditLog
+			c.limiter = server.limiter
+			c.bruteForce = server.bruteForce
+			c.access = server.access
+			c.pools = server.pools
+			c.tlsDatas.forOrigin.setOriginPolicies(server.originTLS)
+
+			server.addSession(c)
+			defer server.removeSession(c)
+
+			err = c.handleCommands()
 			logrus.Info("handle command end runtime goroutine count: ", runtime.NumGoroutine())
 			if err != nil {
 				logrus.Error(err.Error())
@@ -125,6 +331,10 @@ func (server *FtpServer) serve() error {
 		})
 	}
 
+	if err := <-acceptErr; err != nil {
+		return err
+	}
+
 	return eg.Wait()
 }
 
@@ -139,9 +349,20 @@ func (server *FtpServer) Start() error {
 
 	logrus.Info("Starting...")
 
+	// serve metrics by http when metrics listen address is set
+	if len(server.config.MetricsAddr) > 0 {
+		server.metricsServer = server.serveMetrics(server.config.MetricsAddr)
+		go func() {
+			logrus.Info("Metrics listening address ", server.config.MetricsAddr)
+			if err := server.metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logrus.Error("metrics server error: ", err)
+			}
+		}()
+	}
+
 	go func() {
 		if err := server.serve(); err != nil {
-			if !server.shutdown {
+			if !server.shutdown.Load() {
 				lastError = err
 			}
 		}
@@ -153,7 +374,13 @@ func (server *FtpServer) Start() error {
 L:
 	for {
 		switch <-ch {
-		case syscall.SIGHUP, syscall.SIGTERM:
+		case syscall.SIGHUP:
+			if err := server.reload(); err != nil {
+				logrus.Errorf("config reload failed. keep current settings: %v", err)
+			} else {
+				logrus.Info("config reloaded")
+			}
+		case syscall.SIGTERM:
 			if err := server.stop(); err != nil {
 				lastError = err
 			}
@@ -162,15 +389,223 @@ L:
 	}
 
 	<-done
+
+	// all transfers are finished. close audit log
+	if server.auditLog != nil {
+		if err := server.auditLog.Close(); err != nil {
+			lastError = err
+		}
+	}
+
+	if server.bruteForce != nil {
+		if err := server.bruteForce.Close(); err != nil {
+			lastError = err
+		}
+	}
+
+	if err := server.pools.Close(); err != nil {
+		lastError = err
+	}
+
 	return lastError
 }
 
-func (server *FtpServer) stop() error {
-	server.shutdown = true
-	if server.listener != nil {
-		if err := server.listener.Close(); err != nil {
+// reload config file and swap the settings which can be changed live.
+// new settings are used by new sessions and current sessions keep old ones.
+// when any error occurred, all of current settings are kept.
+func (server *FtpServer) reload() error {
+	if len(server.confFile) == 0 {
+		return fmt.Errorf("config file is not specified")
+	}
+
+	c, err := loadConfig(server.confFile)
+	if err != nil {
+		return err
+	}
+
+	newConfigs := make(map[string]*config)
+	for _, lc := range c.listenerConfigs() {
+		newConfigs[lc.ListenAddr] = lc
+	}
+
+	type listenerSettings struct {
+		listener      *ftpListener
+		config        *config
+		serverTLSData *tlsData
+	}
+
+	// build all settings before swap them
+	settings := make([]listenerSettings, 0, len(server.listeners))
+	discard := func() {
+		for _, s := range settings {
+			if s.serverTLSData != nil {
+				s.serverTLSData.stopWatchCertificate()
+			}
+		}
+	}
+	for _, l := range server.listeners {
+		current, _ := l.settings()
+		nc, ok := newConfigs[current.ListenAddr]
+		if !ok {
+			logrus.Warnf("listener %s is not found in new config. changing listen address needs restart", current.ListenAddr)
+			continue
+		}
+		delete(newConfigs, current.ListenAddr)
+
+		rc := current.reloaded(nc)
+		if rc.ImplicitTLS && rc.TLS == nil {
+			discard()
+			return fmt.Errorf("configuration error: implicit TLS listener %s needs TLS settings", rc.ListenAddr)
+		}
+		// require_tls is not reloaded, so TLS can not be removed from the listener
+		if rc.RequireTLS && rc.TLS == nil {
+			discard()
+			return fmt.Errorf("configuration error: require_tls listener %s needs TLS settings", rc.ListenAddr)
+		}
+
+		serverTLSData, err := buildListenerTLSData(rc)
+		if err != nil {
+			discard()
 			return err
 		}
+
+		settings = append(settings, listenerSettings{
+			listener:      l,
+			config:        rc,
+			serverTLSData: serverTLSData,
+		})
+	}
+
+	for addr := range newConfigs {
+		logrus.Warnf("listener %s is ignored. adding listener needs restart", addr)
+	}
+
+	if err := server.access.update(c.Access); err != nil {
+		discard()
+		return err
+	}
+
+	for _, s := range settings {
+		_, old := s.listener.settings()
+		s.listener.setSettings(s.config, s.serverTLSData)
+
+		// new certificate watcher is started by new settings
+		if old != nil {
+			old.stopWatchCertificate()
+		}
 	}
+
 	return nil
 }
+
+func (server *FtpServer) stop() error {
+	server.shutdown.Store(true)
+	lastError := error(nil)
+	for _, l := range server.listeners {
+		if l.listener != nil {
+			if err := l.listener.Close(); err != nil {
+				lastError = err
+			}
+		}
+		if _, serverTLSData := l.settings(); serverTLSData != nil {
+			serverTLSData.stopWatchCertificate()
+		}
+	}
+
+	// wait until sessions end
+	server.drain(time.Duration(server.config.ShutdownTimeout) * time.Second)
+
+	if server.metricsServer != nil {
+		if err := server.metricsServer.Close(); err != nil {
+			lastError = err
+		}
+	}
+
+	return lastError
+}
+
+// register connection which is reading PROXY protocol header
+func (server *FtpServer) addPending(id uint64, conn net.Conn) {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	server.pending[id] = conn
+}
+
+func (server *FtpServer) removePending(id uint64) {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	delete(server.pending, id)
+}
+
+// register session instead of pending connection at once,
+// so drain always finds it in either of them
+func (server *FtpServer) addSession(c *clientHandler) {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	delete(server.pending, c.id)
+	server.sessions[c.id] = c
+}
+
+func (server *FtpServer) removeSession(c *clientHandler) {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	delete(server.sessions, c.id)
+}
+
+func (server *FtpServer) getSessions() ([]*clientHandler, []net.Conn) {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	sessions := make([]*clientHandler, 0, len(server.sessions))
+	for _, c := range server.sessions {
+		sessions = append(sessions, c)
+	}
+
+	pending := make([]net.Conn, 0, len(server.pending))
+	for _, conn := range server.pending {
+		pending = append(pending, conn)
+	}
+
+	return sessions, pending
+}
+
+// drain sessions for graceful shutdown.
+// idle sessions are closed with 421 and sessions in data transfer are
+// waited until transfer finished. When deadline passed, remaining sessions
+// are closed forcibly. returns the number of forcibly closed sessions.
+func (server *FtpServer) drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		sessions, pending := server.getSessions()
+		if len(sessions) == 0 && len(pending) == 0 {
+			logrus.Info("all sessions are closed")
+			return 0
+		}
+
+		// connections before greeting are closed without waiting
+		for _, conn := range pending {
+			conn.Close()
+		}
+
+		if time.Now().After(deadline) {
+			for _, c := range sessions {
+				c.forceClose()
+			}
+			logrus.Warnf("drain deadline exceeded. %d sessions were cut", len(sessions))
+			return len(sessions)
+		}
+
+		for _, c := range sessions {
+			if !c.inDataTransfer.IsSet() {
+				c.closeIdle()
+			}
+		}
+
+		time.Sleep(drainInterval)
+	}
+}
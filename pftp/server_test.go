@@ -0,0 +1,233 @@
+package pftp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_FtpServer_drain(t *testing.T) {
+	tests := []struct {
+		name       string
+		inTransfer bool
+		wantCut    int
+		wantMsg    string
+	}{
+		{
+			name:    "idle_session",
+			wantCut: 0,
+			wantMsg: "421 Service not available, closing control connection\r\n",
+		},
+		{
+			name:       "transfer_session",
+			inTransfer: true,
+			wantCut:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+
+			c := newClientHandler(serverConn, &config{}, nil, nil, 1, new(int32))
+			if tt.inTransfer {
+				c.inDataTransfer.Set()
+			}
+
+			server := &FtpServer{sessions: make(map[uint64]*clientHandler)}
+			server.addSession(c)
+
+			// session ends when client connection is closed
+			msg := make(chan string, 1)
+			go func() {
+				line, _ := bufio.NewReader(clientConn).ReadString('\n')
+				server.removeSession(c)
+				msg <- line
+			}()
+
+			if got := server.drain(500 * time.Millisecond); got != tt.wantCut {
+				t.Errorf("FtpServer.drain() = %v, want %v", got, tt.wantCut)
+			}
+
+			if got := <-msg; got != tt.wantMsg {
+				t.Errorf("FtpServer.drain() sent %q, want %q", got, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func Test_FtpServer_drain_stalled(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	// client does not read 421
+	c := newClientHandler(serverConn, &config{}, nil, nil, 1, new(int32))
+	server := &FtpServer{sessions: make(map[uint64]*clientHandler)}
+	server.addSession(c)
+
+	done := make(chan int, 1)
+	go func() {
+		done <- server.drain(500 * time.Millisecond)
+	}()
+
+	select {
+	case got := <-done:
+		if got != 1 {
+			t.Errorf("FtpServer.drain() = %v, want 1", got)
+		}
+	case <-time.After(drainWriteTimeout + 2*time.Second):
+		t.Fatal("FtpServer.drain() is blocked by stalled client")
+	}
+}
+
+func Test_FtpServer_drain_pending(t *testing.T) {
+	serverConn, clientConn := acceptTestConn(t)
+
+	server := &FtpServer{
+		sessions: make(map[uint64]*clientHandler),
+		pending:  make(map[uint64]net.Conn),
+	}
+	server.addPending(1, serverConn)
+
+	// connection reading PROXY protocol header is closed by drain
+	done := make(chan struct{})
+	go func() {
+		bufio.NewReader(serverConn).ReadString('\n')
+		server.removePending(1)
+		close(done)
+	}()
+
+	if got := server.drain(500 * time.Millisecond); got != 0 {
+		t.Errorf("FtpServer.drain() = %v, want 0", got)
+	}
+	<-done
+
+	if _, err := clientConn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("FtpServer.drain() did not close pending connection")
+	}
+}
+
+func Test_newClientHandler_masqueradeIP(t *testing.T) {
+	serverConn, _ := acceptTestConn(t)
+
+	c := &config{}
+	h := newClientHandler(serverConn, c, nil, nil, 1, new(int32))
+
+	if h.config.MasqueradeIP != "127.0.0.1" {
+		t.Errorf("newClientHandler() MasqueradeIP = %v, want 127.0.0.1", h.config.MasqueradeIP)
+	}
+	if len(c.MasqueradeIP) > 0 {
+		t.Errorf("newClientHandler() changed shared config")
+	}
+}
+
+func Test_FtpServer_reload(t *testing.T) {
+	confFile := filepath.Join(t.TempDir(), "config.toml")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(confFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(`
+listen_addr = "127.0.0.1:2121"
+remote_addr = "127.0.0.1:21"
+idle_timeout = 100
+welcome_message = "old message"
+transfer_mode = "PASV"
+`)
+
+	server, err := NewFtpServer(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := server.listeners[0].settings()
+
+	writeConfig(`
+listen_addr = "127.0.0.1:2121"
+remote_addr = "127.0.0.1:21"
+idle_timeout = 200
+welcome_message = "new message"
+transfer_mode = "EPSV"
+`)
+
+	if err := server.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := server.listeners[0].settings()
+	if got.IdleTimeout != 200 || got.WelcomeMsg != "new message" {
+		t.Errorf("FtpServer.reload() live settings are not applied: idle_timeout=%d welcome_message=%s", got.IdleTimeout, got.WelcomeMsg)
+	}
+	if got.TransferMode != "PASV" {
+		t.Errorf("FtpServer.reload() changed transfer_mode to %s, want PASV", got.TransferMode)
+	}
+	if old.IdleTimeout != 100 || old.WelcomeMsg != "old message" {
+		t.Errorf("FtpServer.reload() changed settings of current sessions")
+	}
+
+	// invalid config is not applied
+	writeConfig(`
+listen_addr = "127.0.0.1:2121"
+remote_addr = "127.0.0.1:21"
+idle_timeout = 300
+masquerade_ip = "invalid"
+`)
+
+	if err := server.reload(); err == nil {
+		t.Errorf("FtpServer.reload() error = nil, want error")
+	}
+	if got, _ := server.listeners[0].settings(); got.IdleTimeout != 200 {
+		t.Errorf("FtpServer.reload() applied invalid config")
+	}
+}
+
+func Test_FtpServer_reload_requireTLS(t *testing.T) {
+	dir := t.TempDir()
+	confFile := filepath.Join(dir, "config.toml")
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCertificate(t, certFile, keyFile, "ftp.example.com")
+
+	writeConfig := func(content string) {
+		if err := os.WriteFile(confFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(fmt.Sprintf(`
+listen_addr = "127.0.0.1:2121"
+remote_addr = "127.0.0.1:21"
+idle_timeout = 100
+require_tls = true
+[tls]
+cert = "%s"
+key = "%s"
+`, certFile, keyFile))
+
+	server, err := NewFtpServer(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, serverTLSData := server.listeners[0].settings()
+	defer serverTLSData.stopWatchCertificate()
+
+	// require_tls is kept by reload, so TLS settings must not be removed
+	writeConfig(`
+listen_addr = "127.0.0.1:2121"
+remote_addr = "127.0.0.1:21"
+idle_timeout = 200
+`)
+
+	if err := server.reload(); err == nil {
+		t.Errorf("FtpServer.reload() error = nil, want error")
+	}
+	if got, _ := server.listeners[0].settings(); got.IdleTimeout != 100 || got.TLS == nil {
+		t.Errorf("FtpServer.reload() applied config without TLS settings")
+	}
+}
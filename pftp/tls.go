@@ -1,12 +1,16 @@
 package pftp
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -50,47 +54,227 @@ func getTLSProtocolName(version uint16) string {
 }
 
 type tlsData struct {
-	rootCA *x509.CertPool
-	cert   *tls.Certificate
-	config *tls.Config
-	mutex  sync.Mutex
+	rootCA    *x509.CertPool
+	cert      *tls.Certificate
+	sniCerts  map[string]*tls.Certificate
+	config    *tls.Config
+	mutex     sync.Mutex
+	stopWatch chan struct{}
+
+	// for verify origin certificate
+	originPolicies *originTLSPolicies
+	originAddr     string
+	// TLS parameters used when origin policy does not set them
+	originParams tlsParams
+	// SNI sent by client. it is passed to origin
+	clientServerName string
+
+	// data connections must resume the session of control connection
+	requireSessionReuse bool
+	dataConfig          *tls.Config
 }
 
 // tls configset for client and origin
 type tlsDataSet struct {
-	forClient   *tlsData
-	forOrigin   *tlsData
-	version     uint16
-	cipherSuite uint16
-	serverName  string
+	forClient  *tlsData
+	forOrigin  *tlsData
+	serverName string
+}
+
+// TLS parameters to origin. zero values mean not set
+type tlsParams struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+}
+
+// fill not set parameters by base parameters
+func (p tlsParams) withDefaults(base tlsParams) tlsParams {
+	if p.minVersion == 0 {
+		p.minVersion = base.minVersion
+	}
+	if p.maxVersion == 0 {
+		p.maxVersion = base.maxVersion
+	}
+	if len(p.cipherSuites) == 0 {
+		p.cipherSuites = base.cipherSuites
+	}
+
+	return p
 }
 
 // build origin side tls config
 // it is working TLS client
 func buildTLSConfigForOrigin(c *config) *tlsData {
+	t := &tlsData{
+		config: nil,
+		rootCA: nil,
+		cert:   nil,
+	}
+
+	// certificate is verified by origin policy in VerifyConnection
+	// because SNI sent to origin may differ from the name to verify
 	tc := &tls.Config{
 		InsecureSkipVerify:     true,
 		ClientSessionCache:     tls.NewLRUClientSessionCache(10),
 		SessionTicketsDisabled: false,
+		VerifyConnection:       t.verifyOriginConnection,
+		GetClientCertificate:   t.getOriginClientCertificate,
 	}
 
+	// origin TLS parameters are independent from the parameters negotiated
+	// with client. if origin policy does not set them, use [tls] settings
 	if c != nil && c.TLS != nil {
-		tc.MinVersion = getTLSProtocol(c.TLS.MinProtocol)
-		tc.MaxVersion = getTLSProtocol(c.TLS.MaxProtocol)
+		t.originParams = tlsParams{
+			minVersion:   getTLSProtocol(c.TLS.MinProtocol),
+			maxVersion:   getTLSProtocol(c.TLS.MaxProtocol),
+			cipherSuites: getCiphers(c.TLS.CipherSuite),
+		}
+		tc.MinVersion = t.originParams.minVersion
+		tc.MaxVersion = t.originParams.maxVersion
+		tc.CipherSuites = t.originParams.cipherSuites
 	}
+	t.config = tc
 
-	return &tlsData{
-		config: tc,
-		rootCA: nil,
-		cert:   nil,
+	return t
+}
+
+// set policies for verify origin certificates
+func (t *tlsData) setOriginPolicies(p *originTLSPolicies) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.originPolicies = p
+}
+
+// set origin address which is connected now and
+// apply TLS parameters of the origin
+func (t *tlsData) setOriginAddr(addr string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.originAddr = addr
+
+	if t.config == nil {
+		return
 	}
+
+	// replace config for not change the config used by running handshake
+	params := t.originPolicies.get(addr).getParams().withDefaults(t.originParams)
+	tc := t.config.Clone()
+	tc.MinVersion = params.minVersion
+	tc.MaxVersion = params.maxVersion
+	tc.CipherSuites = params.cipherSuites
+	tc.ServerName = t.originServerName()
+	t.config = tc
+}
+
+// get client certificate by the policy of current origin.
+// it is used on both control and data connections
+func (t *tlsData) getOriginClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.originPolicies.get(t.originAddr).getClientCertificate(), nil
+}
+
+// verify origin TLS connection by the policy of current origin
+func (t *tlsData) verifyOriginConnection(cs tls.ConnectionState) error {
+	t.mutex.Lock()
+	policy := t.originPolicies.get(t.originAddr)
+	addr := t.originAddr
+	t.mutex.Unlock()
+
+	return policy.verify(addr, cs)
 }
 
 // build client side tls config (pftp works like server)
 // it is working TLS server
 func buildTLSConfigForClient(TLS *tlsPair) (*tlsData, error) {
-	var t *tlsData
+	t := &tlsData{}
+
+	if err := t.loadCertificate(TLS); err != nil {
+		return nil, err
+	}
+
+	// certificate is got from tlsData for swap it without rebuild tls.Config
+	t.config = &tls.Config{
+		NextProtos:               []string{"ftp"},
+		GetCertificate:           t.getCertificate,
+		MinVersion:               getTLSProtocol(TLS.MinProtocol),
+		MaxVersion:               getTLSProtocol(TLS.MaxProtocol),
+		CipherSuites:             getCiphers(TLS.CipherSuite),
+		PreferServerCipherSuites: true,
+		ClientAuth:               getClientAuthType(TLS.ClientAuth),
+		VerifyConnection:         t.verifyTLSConnection,
+	}
+
+	// session configs made by forSession share ticket keys
+	if TLS.RequireSessionReuse {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil, err
+		}
+		t.config.SetSessionTicketKeys([][32]byte{key})
+		t.requireSessionReuse = true
+	}
 
+	return t, nil
+}
+
+// make TLS config for one client session. session tickets issued in the session
+// are tagged, and data connections can resume only the tagged sessions.
+// control connection can resume any session as before.
+func (t *tlsData) forSession() *tlsData {
+	if !t.requireSessionReuse {
+		return t
+	}
+
+	tag := make([]byte, 16)
+	rand.Read(tag)
+
+	tc := t.getTLSConfig().Clone()
+	tc.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		ss.Extra = append(ss.Extra, tag)
+		return tc.EncryptTicket(cs, ss)
+	}
+
+	dc := tc.Clone()
+	dc.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		ss, err := dc.DecryptTicket(identity, cs)
+		if err != nil || ss == nil {
+			return nil, err
+		}
+
+		for _, extra := range ss.Extra {
+			if bytes.Equal(extra, tag) {
+				return ss, nil
+			}
+		}
+
+		// session of other control connection. make full handshake
+		return nil, nil
+	}
+
+	return &tlsData{
+		config:              tc,
+		dataConfig:          dc,
+		requireSessionReuse: true,
+	}
+}
+
+// get tls config for data connection
+func (t *tlsData) getDataTLSConfig() *tls.Config {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.dataConfig != nil {
+		return t.dataConfig
+	}
+	return t.config
+}
+
+// load CA cert and cert/key pair from files and swap them.
+// when any file is invalid, current ones are kept
+func (t *tlsData) loadCertificate(TLS *tlsPair) error {
 	caCertFile := TLS.CACert
 
 	if len(caCertFile) == 0 {
@@ -98,47 +282,125 @@ func buildTLSConfigForClient(TLS *tlsPair) (*tlsData, error) {
 	}
 	caCertPEM, err := os.ReadFile(caCertFile)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	caCert := x509.NewCertPool()
 	ok := caCert.AppendCertsFromPEM(caCertPEM)
 	if !ok {
-		return nil, fmt.Errorf("failed to parse CA cert")
+		return fmt.Errorf("failed to parse CA cert")
+	}
+
+	cert, err := loadKeyPair(TLS.Cert, TLS.Key)
+	if err != nil {
+		return err
+	}
+
+	// certificates selected by SNI
+	sniCerts := make(map[string]*tls.Certificate)
+	for _, sni := range TLS.SNI {
+		sniCert, err := loadKeyPair(sni.Cert, sni.Key)
+		if err != nil {
+			return err
+		}
+		for _, host := range sni.Hosts {
+			sniCerts[strings.ToLower(host)] = sniCert
+		}
 	}
 
-	cert, err := tls.LoadX509KeyPair(TLS.Cert, TLS.Key)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rootCA = caCert
+	t.cert = cert
+	t.sniCerts = sniCerts
+
+	return nil
+}
+
+// load cert/key pair and log its expiry
+func loadKeyPair(certFile string, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return nil, fmt.Errorf("TLS configuration error: %s", err.Error())
 	}
 
-	t = &tlsData{
-		config: nil,
-		rootCA: caCert,
-		cert:   &cert,
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("TLS configuration error: %s", err.Error())
+		}
 	}
 
-	t.config = &tls.Config{
-		NextProtos:               []string{"ftp"},
-		Certificates:             []tls.Certificate{cert},
-		MinVersion:               getTLSProtocol(TLS.MinProtocol),
-		MaxVersion:               getTLSProtocol(TLS.MaxProtocol),
-		CipherSuites:             getCiphers(TLS.CipherSuite),
-		PreferServerCipherSuites: true,
-		VerifyConnection:         t.verifyTLSConnection,
+	if time.Now().After(cert.Leaf.NotAfter) {
+		logrus.Warnf("TLS certificate %s is already expired at %s", certFile, cert.Leaf.NotAfter)
+	} else {
+		logrus.Infof("TLS certificate %s loaded. expires at %s", certFile, cert.Leaf.NotAfter)
 	}
 
-	return t, nil
+	return &cert, nil
 }
 
-// verify TLS connection using Peer certificates
+// get certificate for TLS handshake by server name of ClientHello.
+// exact host name is preferred to wildcard, and default certificate
+// is used when no certificate matched
+func (t *tlsData) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if hello != nil && len(hello.ServerName) > 0 {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if cert, ok := t.sniCerts[name]; ok {
+			return cert, nil
+		}
+
+		if i := strings.Index(name, "."); i > 0 {
+			if cert, ok := t.sniCerts["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+
+	return t.cert, nil
+}
+
+// get client certificate request type.
+// certificates are verified by verifyTLSConnection with reloadable CA
+func getClientAuthType(clientAuth string) tls.ClientAuthType {
+	switch clientAuth {
+	case clientAuthOptional:
+		return tls.RequestClientCert
+	case clientAuthRequired:
+		return tls.RequireAnyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// get FTP user name from client certificate
+func getClientCertUser(cert *x509.Certificate, field string) string {
+	switch field {
+	case clientCertUserEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case clientCertUserDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
+
+// verify TLS connection using Peer(client) certificates
 func (t *tlsData) verifyTLSConnection(cs tls.ConnectionState) error {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 	opts := x509.VerifyOptions{
 		Roots:         t.rootCA,
-		DNSName:       cs.ServerName,
 		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
 
 	if len(cs.PeerCertificates) > 0 {
@@ -164,26 +426,28 @@ func (t *tlsData) getTLSConfig() *tls.Config {
 	return t.config
 }
 
-// set specific tls version to tls.Config
-func (t *tlsData) setSpecificTLSVersion(tlsVersion uint16) {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	t.config.MinVersion = tlsVersion
-	t.config.MaxVersion = tlsVersion
-}
-
 // set server name to tls.Config
 func (t *tlsData) setServerName(name string) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
-	t.config.ServerName = name
+	t.clientServerName = name
+	t.config.ServerName = t.originServerName()
 }
 
-// set specific cipher suite name to tls.Config
-func (t *tlsData) setCipherSUite(cipherSuite uint16) {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	t.config.CipherSuites = []uint16{cipherSuite}
+// server name sent to origin. if client does not send SNI, use origin host
+// because TLS session cache is keyed by server name, and data connections
+// can not resume the session of control connection by empty server name
+func (t *tlsData) originServerName() string {
+	if len(t.clientServerName) > 0 {
+		return t.clientServerName
+	}
+
+	host, _, err := net.SplitHostPort(t.originAddr)
+	if err != nil {
+		return t.originAddr
+	}
+
+	return host
 }
 
 // get available Ciphersuites from config
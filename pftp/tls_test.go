@@ -0,0 +1,438 @@
+package pftp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_tlsData_getCertificate(t *testing.T) {
+	dir := t.TempDir()
+	pair := &tlsPair{
+		Cert: filepath.Join(dir, "default.crt"),
+		Key:  filepath.Join(dir, "default.key"),
+	}
+	writeTestCertificate(t, pair.Cert, pair.Key, "default.example.com")
+
+	for _, name := range []string{"foo.example.com", "wildcard.example.com"} {
+		sni := &sniCert{
+			Cert: filepath.Join(dir, name+".crt"),
+			Key:  filepath.Join(dir, name+".key"),
+		}
+		writeTestCertificate(t, sni.Cert, sni.Key, name)
+		pair.SNI = append(pair.SNI, sni)
+	}
+	pair.SNI[0].Hosts = []string{"foo.example.com", "FOO.example.net"}
+	pair.SNI[1].Hosts = []string{"*.example.com"}
+
+	tlsData, err := buildTLSConfigForClient(pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{serverName: "foo.example.com", want: "foo.example.com"},
+		{serverName: "foo.example.net", want: "foo.example.com"},
+		{serverName: "Foo.Example.Com.", want: "foo.example.com"},
+		{serverName: "bar.example.com", want: "wildcard.example.com"},
+		{serverName: "example.com", want: "default.example.com"},
+		{serverName: "bar.foo.example.com", want: "default.example.com"},
+		{serverName: "", want: "default.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			cert, err := tlsData.getCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cert.Leaf.Subject.CommonName; got != tt.want {
+				t.Errorf("tlsData.getCertificate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tlsData_verifyTLSConnection(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := filepath.Join(dir, "server.crt")
+	serverKey := filepath.Join(dir, "server.key")
+	writeTestCertificate(t, serverCert, serverKey, "ftp.example.com")
+
+	clientCert := filepath.Join(dir, "client.crt")
+	clientKey := filepath.Join(dir, "client.key")
+	writeTestCertificate(t, clientCert, clientKey, "prouser")
+
+	otherCert := filepath.Join(dir, "other.crt")
+	otherKey := filepath.Join(dir, "other.key")
+	writeTestCertificate(t, otherCert, otherKey, "prouser")
+
+	tests := []struct {
+		name       string
+		clientAuth string
+		certFile   string
+		keyFile    string
+		wantErr    bool
+	}{
+		{name: "required_trusted", clientAuth: clientAuthRequired, certFile: clientCert, keyFile: clientKey, wantErr: false},
+		{name: "required_untrusted", clientAuth: clientAuthRequired, certFile: otherCert, keyFile: otherKey, wantErr: true},
+		{name: "required_no_cert", clientAuth: clientAuthRequired, wantErr: true},
+		{name: "optional_no_cert", clientAuth: clientAuthOptional, wantErr: false},
+		{name: "optional_untrusted", clientAuth: clientAuthOptional, certFile: otherCert, keyFile: otherKey, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsData, err := buildTLSConfigForClient(&tlsPair{
+				Cert:       serverCert,
+				Key:        serverKey,
+				CACert:     clientCert,
+				ClientAuth: tt.clientAuth,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clientConfig := &tls.Config{InsecureSkipVerify: true}
+			if len(tt.certFile) > 0 {
+				cert, err := tls.LoadX509KeyPair(tt.certFile, tt.keyFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				clientConfig.Certificates = []tls.Certificate{cert}
+			}
+
+			// use TCP connection because alert is sent while client is writing
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			go func() {
+				clientConn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					return
+				}
+				defer clientConn.Close()
+
+				tlsConn := tls.Client(clientConn, clientConfig)
+				if err := tlsConn.Handshake(); err == nil {
+					// wait for server result of verification
+					tlsConn.Read(make([]byte, 1))
+				}
+			}()
+
+			serverConn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer serverConn.Close()
+
+			err = tls.Server(serverConn, tlsData.getTLSConfig()).Handshake()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyTLSConnection() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_getClientCertUser(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "prouser"},
+		EmailAddresses: []string{"prouser@example.com"},
+	}
+
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{field: clientCertUserCN, want: "prouser"},
+		{field: clientCertUserEmail, want: "prouser@example.com"},
+		{field: clientCertUserDNS, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			if got := getClientCertUser(cert, tt.field); got != tt.want {
+				t.Errorf("getClientCertUser() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tlsData_forSession(t *testing.T) {
+	dir := t.TempDir()
+	pair := &tlsPair{
+		Cert:                filepath.Join(dir, "server.crt"),
+		Key:                 filepath.Join(dir, "server.key"),
+		RequireSessionReuse: true,
+	}
+	writeTestCertificate(t, pair.Cert, pair.Key, "ftp.example.com")
+
+	shared, err := buildTLSConfigForClient(pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionA := shared.forSession()
+	sessionB := shared.forSession()
+
+	clientConfig := &tls.Config{
+		ServerName:         "ftp.example.com",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(10),
+	}
+
+	// returns whether server resumed the session
+	handshake := func(serverConfig *tls.Config) bool {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		resumed := make(chan bool, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				resumed <- false
+				return
+			}
+			defer conn.Close()
+
+			tlsConn := tls.Server(conn, serverConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				resumed <- false
+				return
+			}
+			tlsConn.Write([]byte("x"))
+			resumed <- tlsConn.ConnectionState().DidResume
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, clientConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		// read session ticket
+		tlsConn.Read(make([]byte, 1))
+
+		return <-resumed
+	}
+
+	steps := []struct {
+		name   string
+		config *tls.Config
+		want   bool
+	}{
+		{name: "control_A", config: sessionA.getTLSConfig(), want: false},
+		{name: "data_A", config: sessionA.getDataTLSConfig(), want: true},
+		{name: "data_B_with_session_A", config: sessionB.getDataTLSConfig(), want: false},
+		{name: "control_A_with_session_B", config: sessionA.getTLSConfig(), want: true},
+	}
+
+	for _, step := range steps {
+		if got := handshake(step.config); got != step.want {
+			t.Errorf("%s resumed = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func Test_tlsData_originServerName(t *testing.T) {
+	tlsData := buildTLSConfigForOrigin(nil)
+
+	tlsData.setOriginAddr("origin.example.com:21")
+	if got := tlsData.getTLSConfig().ServerName; got != "origin.example.com" {
+		t.Errorf("server name without client SNI = %v, want origin.example.com", got)
+	}
+
+	tlsData.setServerName("ftp.example.com")
+	tlsData.setOriginAddr("127.0.0.1:21")
+	if got := tlsData.getTLSConfig().ServerName; got != "ftp.example.com" {
+		t.Errorf("server name with client SNI = %v, want ftp.example.com", got)
+	}
+}
+
+func Test_clientHandler_handleImplicitTLS(t *testing.T) {
+	dir := t.TempDir()
+	pair := &tlsPair{
+		Cert: filepath.Join(dir, "server.crt"),
+		Key:  filepath.Join(dir, "server.key"),
+	}
+	writeTestCertificate(t, pair.Cert, pair.Key, "ftp.example.com")
+
+	shared, err := buildTLSConfigForClient(pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		tlsData   *tlsData
+		wantErr   bool
+		wantCmds  []string
+		wantInTLS bool
+	}{
+		{
+			name:      "handshake",
+			tlsData:   shared,
+			wantCmds:  []string{"AUTH TLS\r\n", "PBSZ 0\r\n", "PROT P\r\n"},
+			wantInTLS: true,
+		},
+		{
+			name:    "no_tls_config",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+
+			c := newClientHandler(serverConn, &config{ImplicitTLS: true, TLS: pair}, tt.tlsData, nil, 1, new(int32))
+			defer c.Close()
+
+			// client starts TLS handshake without AUTH
+			clientErr := make(chan error, 1)
+			go func() {
+				if tt.wantErr {
+					clientErr <- nil
+					return
+				}
+				tlsConn := tls.Client(clientConn, &tls.Config{ServerName: "ftp.example.com", InsecureSkipVerify: true})
+				clientErr <- tlsConn.Handshake()
+				// drain session tickets so the server does not block on the pipe
+				io.Copy(io.Discard, tlsConn)
+			}()
+
+			err := c.handleImplicitTLS()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("clientHandler.handleImplicitTLS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := <-clientErr; err != nil {
+				t.Fatalf("client handshake error = %v", err)
+			}
+
+			if c.controlInTLS.IsSet() != tt.wantInTLS || c.transferInTLS.IsSet() != tt.wantInTLS {
+				t.Errorf("clientHandler.handleImplicitTLS() control and transfer in TLS = %v, %v, want %v", c.controlInTLS.IsSet(), c.transferInTLS.IsSet(), tt.wantInTLS)
+			}
+			if !reflect.DeepEqual(c.previousTLSCommands, tt.wantCmds) {
+				t.Errorf("clientHandler.handleImplicitTLS() previousTLSCommands = %q, want %q", c.previousTLSCommands, tt.wantCmds)
+			}
+			if _, ok := c.conn.(*tls.Conn); ok != tt.wantInTLS {
+				t.Errorf("clientHandler.handleImplicitTLS() conn is TLS = %v, want %v", ok, tt.wantInTLS)
+			}
+		})
+	}
+}
+
+func Test_proxyServer_sendTLSCommand(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "origin.crt")
+	keyFile := filepath.Join(dir, "origin.key")
+	writeTestCertificate(t, certFile, keyFile, "origin.example.com")
+
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{*cert}}
+
+	commands := []string{"AUTH TLS\r\n", "PBSZ 0\r\n", "PROT P\r\n"}
+
+	tests := []struct {
+		name     string
+		implicit bool
+		want     []string
+	}{
+		{
+			name: "explicit",
+			want: []string{"AUTH TLS", "PBSZ 0", "PROT P"},
+		},
+		{
+			// AUTH is skipped because origin connection is already TLS
+			name:     "implicit",
+			implicit: true,
+			want:     []string{"PBSZ 0", "PROT P"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pftpConn, originConn := net.Pipe()
+			defer pftpConn.Close()
+
+			var origin net.Conn = originConn
+			var conn net.Conn = pftpConn
+			if tt.implicit {
+				origin = tls.Server(originConn, serverTLS)
+				conn = tls.Client(pftpConn, &tls.Config{InsecureSkipVerify: true})
+			}
+
+			// origin records commands until PROT
+			received := make(chan []string, 1)
+			go func() {
+				defer origin.Close()
+
+				got := []string{}
+				reader := bufio.NewReader(origin)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						received <- got
+						return
+					}
+					got = append(got, strings.TrimSuffix(line, "\r\n"))
+
+					switch getCommand(line)[0] {
+					case "AUTH":
+						origin.Write([]byte("234 Proceed with negotiation.\r\n"))
+						origin = tls.Server(origin, serverTLS)
+						reader = bufio.NewReader(origin)
+					case "PBSZ":
+						origin.Write([]byte("200 PBSZ set to 0.\r\n"))
+					case "PROT":
+						origin.Write([]byte("200 PROT now Private.\r\n"))
+						received <- got
+						return
+					}
+				}
+			}()
+
+			s := &proxyServer{
+				origin:       conn,
+				originReader: bufio.NewReader(conn),
+				originWriter: bufio.NewWriter(conn),
+				tlsDatas:     &tlsDataSet{forOrigin: buildTLSConfigForOrigin(nil)},
+				log:          &logger{},
+				config:       &config{OriginImplicit: tt.implicit},
+			}
+
+			if err := s.sendTLSCommand(commands); err != nil {
+				t.Fatalf("proxyServer.sendTLSCommand() error = %v", err)
+			}
+			if got := <-received; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("origin received %q, want %q", got, tt.want)
+			}
+			if _, ok := s.origin.(*tls.Conn); !ok {
+				t.Errorf("proxyServer.sendTLSCommand() origin is not TLS")
+			}
+		})
+	}
+}
@@ -105,7 +105,7 @@ func (getUserDomain) Get(rw http.ResponseWriter, r *http.Request, ps httprouter.
 		return response{200, "Username found", domains[1]}
 	}
 
-	return response{400, "Username not found", ""}
+	return response{404, "Username not found", ""}
 }
 
 // LaunchTestRestServer Launch test server